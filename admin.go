@@ -7,6 +7,7 @@ package main
 // Run some scripts to setup your instance
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"golang.org/x/crypto/bcrypt"
@@ -16,14 +17,16 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 )
 
 // TODO improve cli
 func runAdminCommand() {
 	args := flag.Args() // again?
 	if len(args) < 3 {
-		fmt.Println("Expected subcommand with parameter activate-user|delete-user|make-admin|rename-user")
+		fmt.Println("Expected subcommand with parameter activate-user|delete-user|make-admin|rename-user|set-password|forget-proxy-host|import-files|check-links")
 		os.Exit(1)
 	}
 	var err error
@@ -50,6 +53,15 @@ func runAdminCommand() {
 			log.Fatal(err)
 		}
 		err = setPassword(username, bytePassword)
+	case "forget-proxy-host":
+		hostname := args[2]
+		err = forgetKnownHost(hostname)
+	case "import-files":
+		username := args[2]
+		err = importFiles(username, args[3:])
+	case "check-links":
+		username := args[2]
+		err = printBrokenLinks(username)
 	}
 	if err != nil {
 		log.Fatal(err)
@@ -102,11 +114,10 @@ And here's a guide to the text format that this site uses to create pages. These
 => //admin.flounder.online/gemini_text_guide.gmi
 
 Have fun!`
-	// Redundant filepath.Clean call just in case.
-	username = filepath.Clean(username)
-	os.Mkdir(path.Join(c.FilesDirectory, username), os.ModePerm)
-	ioutil.WriteFile(path.Join(c.FilesDirectory, username, "index.gmi"), []byte(baseIndex), 0644)
-	os.Mkdir(path.Join(c.FilesDirectory, username), os.ModePerm)
+	userFolder := getUserDirectory(username)
+	store.Mkdir(userFolder)
+	store.Write(path.Join(userFolder, "index.gmi"), strings.NewReader(baseIndex))
+	indexFile(username, "index.gmi", time.Now(), []byte(baseIndex))
 	if c.SMTPUsername != "" {
 		// TODO move into work queue
 		SendEmail(email, fmt.Sprintf("Welcome to %s!", c.SiteTitle), fmt.Sprintf(`
@@ -124,35 +135,133 @@ func renameUser(oldUsername string, newUsername string) error {
 	if err != nil {
 		return err
 	}
-	res, err := DB.Exec("UPDATE user set username = ? WHERE username = ?", newUsername, oldUsername)
+	// Nothing can change the user's files while they move, or write to the
+	// new name's folder. The locks are taken in order, so two renames can't
+	// wait on each other.
+	first, second := oldUsername, newUsername
+	if second < first {
+		first, second = second, first
+	}
+	unlock := lockUser(first)
+	defer unlock()
+	if second != first {
+		unlockSecond := lockUser(second)
+		defer unlockSecond()
+	}
+	tx, err := DB.Begin()
 	if err != nil {
 		return err
 	}
+	res, err := tx.Exec("UPDATE user set username = ? WHERE username = ?", newUsername, oldUsername)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
 	rowsAffected, err := res.RowsAffected()
-	if rowsAffected != 1 {
+	if err != nil {
+		tx.Rollback()
+		return err
+	} else if rowsAffected != 1 {
+		tx.Rollback()
 		return fmt.Errorf("No User updated %s %s", oldUsername, newUsername)
-	} else if err != nil {
+	}
+	for _, stmt := range []string{
+		"UPDATE proxy_identity set username = ? WHERE username = ?",
+		"UPDATE user_usage set username = ? WHERE username = ?",
+		"UPDATE file_index set username = ? WHERE username = ?",
+		"UPDATE search_index set username = ? WHERE username = ?",
+		"UPDATE feed_folder set username = ? WHERE username = ?",
+		"UPDATE file_state set username = ? WHERE username = ?",
+		"UPDATE file_published set username = ? WHERE username = ?",
+		"UPDATE site_theme set username = ? WHERE username = ?",
+		"UPDATE site_config set username = ? WHERE username = ?",
+		"UPDATE subscription set username = ? WHERE username = ?",
+		"UPDATE gemini_identity set username = ? WHERE username = ?",
+		"UPDATE mention set target_username = ? WHERE target_username = ?",
+		"UPDATE mention set source_username = ? WHERE source_username = ?",
+		"UPDATE webmention_sent set source_username = ? WHERE source_username = ?",
+	} {
+		_, err = tx.Exec(stmt, newUsername, oldUsername)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	// Broken links are found again with the new host by the next check, and
+	// planet entry links include the username, so they're rebuilt below.
+	// Pending Gemini connection and proxy login tokens are dropped.
+	for _, stmt := range []string{
+		"DELETE FROM broken_link WHERE username = ?",
+		"DELETE FROM planet_entry WHERE username = ?",
+		"DELETE FROM gemini_connect_token WHERE username = ?",
+		"DELETE FROM proxy_login_token WHERE username = ?",
+	} {
+		_, err = tx.Exec(stmt, oldUsername)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	err = store.Rename(getUserDirectory(oldUsername), getUserDirectory(newUsername))
+	if err != nil {
+		tx.Rollback()
 		return err
 	}
-	userFolder := path.Join(c.FilesDirectory, oldUsername)
-	newUserFolder := path.Join(c.FilesDirectory, newUsername)
-	err = os.Rename(userFolder, newUserFolder)
+	err = tx.Commit()
 	if err != nil {
-		// This would be bad. User in broken, insecure state.
-		// TODO some sort of better handling?
+		// Put the files back where the user's rows still point
+		if renameErr := store.Rename(getUserDirectory(newUsername), getUserDirectory(oldUsername)); renameErr != nil {
+			// This would be bad. User in broken, insecure state.
+			log.Println(renameErr)
+		}
 		return err
 	}
+	err = refreshPlanetEntries(newUsername)
+	if err != nil {
+		log.Println(err)
+	}
 	log.Printf("Changed username from %s to %s", oldUsername, newUsername)
 	return nil
 }
 
 func deleteUser(username string) error {
-	_, err := DB.Exec("DELETE FROM user WHERE username = $1", username)
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	for _, stmt := range []string{
+		"DELETE FROM user WHERE username = ?",
+		"DELETE FROM proxy_identity WHERE username = ?",
+		"DELETE FROM user_usage WHERE username = ?",
+		"DELETE FROM file_index WHERE username = ?",
+		"DELETE FROM search_index WHERE username = ?",
+		"DELETE FROM feed_folder WHERE username = ?",
+		"DELETE FROM file_state WHERE username = ?",
+		"DELETE FROM file_published WHERE username = ?",
+		"DELETE FROM site_theme WHERE username = ?",
+		"DELETE FROM site_config WHERE username = ?",
+		"DELETE FROM broken_link WHERE username = ?",
+		"DELETE FROM planet_entry WHERE username = ?",
+		"DELETE FROM subscription_entry WHERE subscription_id IN (SELECT id FROM subscription WHERE username = ?)",
+		"DELETE FROM subscription WHERE username = ?",
+		"DELETE FROM gemini_identity WHERE username = ?",
+		"DELETE FROM gemini_connect_token WHERE username = ?",
+		"DELETE FROM proxy_login_token WHERE username = ?",
+		"DELETE FROM mention WHERE target_username = ?",
+		"DELETE FROM mention WHERE source_username = ?",
+		"DELETE FROM webmention_sent WHERE source_username = ?",
+	} {
+		_, err = tx.Exec(stmt, username)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	err = tx.Commit()
 	if err != nil {
 		return err
 	}
-	username = filepath.Clean(username)
-	err = os.RemoveAll(path.Join(c.FilesDirectory, username))
+	err = store.RemoveAll(getUserDirectory(username))
 	if err != nil {
 		// bad state
 		return err
@@ -160,3 +269,72 @@ func deleteUser(username string) error {
 	log.Println("Deleted user", username)
 	return nil
 }
+
+// Convert Markdown and HTML files, or folders of them, into gemtext in a
+// user's site. Paths are kept relative to the folder given.
+func importFiles(username string, sources []string) error {
+	userFolder := getUserDirectory(username)
+	if _, err := store.Stat(userFolder); err != nil {
+		return fmt.Errorf("No files for user %s", username)
+	}
+	for _, source := range sources {
+		err := filepath.Walk(source, func(thepath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || !canImport(thepath) {
+				return nil
+			}
+			rel, err := filepath.Rel(source, thepath)
+			if err != nil || rel == "." {
+				rel = filepath.Base(thepath)
+			}
+			content, err := ioutil.ReadFile(thepath)
+			if err != nil {
+				return err
+			}
+			name, gmi, err := importToGemtext(filepath.ToSlash(rel), content)
+			if err != nil {
+				log.Printf("Skipping %s: %s", thepath, err)
+				return nil
+			}
+			err = store.Write(userFilePath(username, name), bytes.NewReader(gmi))
+			if err != nil {
+				return err
+			}
+			log.Printf("Imported %s as %s", thepath, name)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// These writes skip the usage accounting and the file index
+	unlock := lockUser(username)
+	defer unlock()
+	_, err := setUserUsage(username)
+	if err != nil {
+		return err
+	}
+	return reindexUserFiles(username)
+}
+
+// Check a user's site for broken links and print the report
+func printBrokenLinks(username string) error {
+	if _, err := getUserByName(username); err != nil {
+		return fmt.Errorf("No user %s", username)
+	}
+	report, err := checkSiteLinks(username)
+	if err != nil {
+		return err
+	}
+	for _, r := range report {
+		if r.Name != "" {
+			fmt.Printf("%s:%d: %s (%s)\n", r.Name, r.Line, r.URL, r.Reason)
+		} else {
+			fmt.Printf("%s: %d requests (%s)\n", r.URL, r.Hits, r.Reason)
+		}
+	}
+	fmt.Printf("%d broken links\n", len(report))
+	return nil
+}
@@ -0,0 +1,201 @@
+// Extracting uploaded zip and tar archives into a user's site
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+type uploadResult struct {
+	Name   string
+	Status string // e.g. "written", "skipped"
+	Error  string
+}
+
+type extractOptions struct {
+	// Check the archive without writing anything
+	DryRun bool
+	// Replace files that already exist
+	Overwrite bool
+	// Convert Markdown and HTML files to gemtext
+	Import bool
+}
+
+func isArchive(filename string) bool {
+	name := strings.ToLower(filename)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// Read at most MaxFileBytes, so that e.g. a small archive can't expand
+// into something huge in memory.
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, int64(c.MaxFileBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > c.MaxFileBytes {
+		return nil, fmt.Errorf("File too large. Max file size is %d", c.MaxFileBytes)
+	}
+	return data, nil
+}
+
+// Calls fn for each regular file in a zip or tar archive. Directories,
+// links and the like are left out.
+func walkArchive(filename string, r io.ReaderAt, size int64, fn func(name string, size int64, body io.Reader) error) error {
+	name := strings.ToLower(filename)
+	if strings.HasSuffix(name, ".zip") {
+		zr, err := zip.NewReader(r, size)
+		if err != nil {
+			return err
+		}
+		for _, f := range zr.File {
+			if !f.Mode().IsRegular() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(f.Name, int64(f.UncompressedSize64), rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var tr io.Reader = io.NewSectionReader(r, 0, size)
+	if strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz") {
+		gz, err := gzip.NewReader(tr)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		tr = gz
+	}
+	archive := tar.NewReader(tr)
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		err = fn(hdr.Name, hdr.Size, archive)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Path of an archive entry within the user's folder. Names that would
+// escape it, like "../x" or "/etc/x", are refused.
+func archiveEntryPath(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	clean := path.Clean(name)
+	if path.IsAbs(name) || clean == ".." || strings.HasPrefix(clean, "../") || clean == "." {
+		return "", fmt.Errorf("Invalid path in archive")
+	}
+	return clean, nil
+}
+
+// Site archives from /my_site/flounder-archive.zip have everything in a
+// folder named after the user, which is dropped so they round-trip.
+func stripArchiveRoot(names []string, username string) bool {
+	for _, name := range names {
+		if !strings.HasPrefix(name, username+"/") {
+			return false
+		}
+	}
+	return len(names) > 0
+}
+
+// Extract an archive into the user's folder, checking each file as if it
+// were uploaded on its own.
+func extractArchive(username string, filename string, r io.ReaderAt, size int64, opts extractOptions) ([]uploadResult, error) {
+	// A first pass to check the archive as a whole. checkUserFile only sees
+	// what's been written so far, which matters for dry runs.
+	var names []string
+	var total int64
+	err := walkArchive(filename, r, size, func(name string, size int64, _ io.Reader) error {
+		if len(names) >= c.MaxFilesPerUser {
+			return fmt.Errorf("Archive has more than %d files", c.MaxFilesPerUser)
+		}
+		names = append(names, name)
+		total += size
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	stripRoot := stripArchiveRoot(names, username)
+	usage, err := getUserUsage(username)
+	used := usage.Bytes
+	for _, name := range names {
+		if stripRoot {
+			name = strings.TrimPrefix(name, username+"/")
+		}
+		// Files that will be replaced don't count twice
+		if info, statErr := store.Stat(userFilePath(username, name)); statErr == nil && opts.Overwrite {
+			used -= info.Size()
+		}
+	}
+	if err != nil || used+total > c.MaxUserBytes {
+		return nil, fmt.Errorf("You are out of storage space. The archive contains %d bytes of files.", total)
+	}
+
+	var results []uploadResult
+	err = walkArchive(filename, r, size, func(name string, size int64, body io.Reader) error {
+		if stripRoot {
+			name = strings.TrimPrefix(name, username+"/")
+		}
+		result := uploadResult{Name: name}
+		name, err := archiveEntryPath(name)
+		if err == nil && opts.Import && canImport(name) {
+			var data []byte
+			data, err = readLimited(body)
+			if err == nil {
+				name, data, err = importToGemtext(name, data)
+				body, size = bytes.NewReader(data), int64(len(data))
+			}
+		}
+		if err == nil {
+			result.Name = name
+			err = checkUserFile(username, name, size)
+		}
+		if err == nil {
+			if _, statErr := store.Stat(userFilePath(username, name)); statErr == nil && !opts.Overwrite {
+				err = fmt.Errorf("File already exists")
+			}
+		}
+		if err == nil && !opts.DryRun {
+			err = writeUserFile(username, name, body)
+		}
+		if err != nil {
+			result.Status = "skipped"
+			result.Error = err.Error()
+		} else if opts.DryRun {
+			result.Status = "would be written"
+		} else {
+			result.Status = "written"
+		}
+		results = append(results, result)
+		return nil
+	})
+	return results, err
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestArchiveEntryPath(t *testing.T) {
+	for _, name := range []string{"../x.gmi", "/etc/passwd", "a/../../x.gmi", "..\\x.gmi", "."} {
+		if _, err := archiveEntryPath(name); err == nil {
+			t.Errorf("Archive path %s should be refused, but wasn't", name)
+		}
+	}
+	for name, want := range map[string]string{"index.gmi": "index.gmi", "a/./b/../c.gmi": "a/c.gmi"} {
+		if got, err := archiveEntryPath(name); err != nil || got != want {
+			t.Errorf("archiveEntryPath(%q) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// A report of the broken links in each site, rebuilt in the background.
+// Links in gemtext pages are checked against the files, and requests that
+// got a 404 can be taken from the analytics log.
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	gmi "git.sr.ht/~adnano/go-gemini"
+)
+
+// How far back to look in the log for 404s
+const brokenLinkLogDays = 7
+
+type BrokenLinkReport struct {
+	Name string // page with the link, empty for 404s from the log
+	BrokenLink
+	Hits      int // 404s in the log
+	CheckedAt int64
+}
+
+// Find the broken links in a user's gemtext pages, outside of hidden folders
+func findBrokenLinks(username string) ([]BrokenLinkReport, error) {
+	var report []BrokenLinkReport
+	err := store.Walk(getUserDirectory(username), func(thepath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := getLocalPath(thepath)
+		if info.IsDir() || !isGemini(name) || inHiddenFolder(name) {
+			return nil
+		}
+		content, err := readStorageFile(thepath)
+		if err != nil {
+			return err
+		}
+		text, err := gmi.ParseText(bytes.NewReader(content))
+		if err != nil {
+			return nil
+		}
+		for _, l := range checkLinks(username, name, text) {
+			report = append(report, BrokenLinkReport{Name: name, BrokenLink: l})
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Paths on a user's site that got 404s over HTTP recently, from the
+// analytics log
+func findLoggedNotFound(username string) ([]BrokenLinkReport, error) {
+	db, err := getAnalyticsDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	hosts := []interface{}{username + "." + c.Host}
+	for domain, user := range domains {
+		if user == username {
+			hosts = append(hosts, domain)
+		}
+	}
+	since := time.Now().AddDate(0, 0, -brokenLinkLogDays).Format(time.RFC3339)
+	rows, err := db.Query(`SELECT path, count(*), max(coalesce(referer, '')) FROM log
+  WHERE protocol = 'http' AND status = 404 AND timestamp >= ? AND destination_host IN (?`+strings.Repeat(", ?", len(hosts)-1)+`)
+  GROUP BY path ORDER BY count(*) DESC LIMIT 100`, append([]interface{}{since}, hosts...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var report []BrokenLinkReport
+	for rows.Next() {
+		var r BrokenLinkReport
+		var referer string
+		err = rows.Scan(&r.URL, &r.Hits, &referer)
+		if err != nil {
+			return nil, err
+		}
+		r.Reason = "not found"
+		if referer = strings.Trim(referer, `"`); referer != "" && referer != "-" {
+			r.Reason += ", linked from " + referer
+		}
+		report = append(report, r)
+	}
+	return report, rows.Err()
+}
+
+// Rebuild a user's report
+func checkSiteLinks(username string) ([]BrokenLinkReport, error) {
+	report, err := findBrokenLinks(username)
+	if err != nil {
+		return nil, err
+	}
+	if c.BrokenLinksFromLog && c.AnalyticsDBFile != "" {
+		logged, err := findLoggedNotFound(username)
+		if err != nil {
+			// The report on pages is still useful
+			log.Println(err)
+		}
+		report = append(report, logged...)
+	}
+	now := time.Now().Unix()
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("DELETE FROM broken_link WHERE username = ?", username)
+	for i := range report {
+		if err != nil {
+			break
+		}
+		report[i].CheckedAt = now
+		r := report[i]
+		_, err = tx.Exec(`INSERT OR IGNORE INTO broken_link (username, name, line, url, reason, hits, checked_at)
+VALUES (?, ?, ?, ?, ?, ?, ?)`, username, r.Name, r.Line, r.URL, r.Reason, r.Hits, now)
+	}
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return report, tx.Commit()
+}
+
+// A user's report from the last check, pages first
+func getBrokenLinks(username string) ([]BrokenLinkReport, error) {
+	rows, err := DB.Query(`SELECT name, line, url, reason, hits, checked_at FROM broken_link
+  WHERE username = ? ORDER BY name = '', name, line, hits DESC`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	report := []BrokenLinkReport{}
+	for rows.Next() {
+		var r BrokenLinkReport
+		err = rows.Scan(&r.Name, &r.Line, &r.URL, &r.Reason, &r.Hits, &r.CheckedAt)
+		if err != nil {
+			return nil, err
+		}
+		report = append(report, r)
+	}
+	return report, rows.Err()
+}
+
+// Check every active user's site
+func checkAllSiteLinks() {
+	users, err := getUsers()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, user := range users {
+		if !user.Active {
+			continue
+		}
+		_, err = checkSiteLinks(user.Username)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func brokenLinkWorker() {
+	log.Println("Starting broken link worker")
+	for {
+		checkAllSiteLinks()
+		time.Sleep(6 * time.Hour)
+	}
+}
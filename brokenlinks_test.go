@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBrokenLinkReport(t *testing.T) {
+	defer setupStorageTest(t)()
+	c.AnalyticsDBFile = path.Join(t.TempDir(), "analytics.db")
+	c.BrokenLinksFromLog = true
+	addTestUser(t, "alex", true)
+	writeUserFile("alex", "a.gmi", strings.NewReader("=> b.gmi\n=> c.gmi"))
+	writeUserFile("alex", "b.gmi", strings.NewReader("=> a.gmi"))
+	writeUserFile("alex", HiddenFolder+"/d.gmi", strings.NewReader("=> e.gmi"))
+	db, err := getAnalyticsDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Exec(`INSERT INTO log (timestamp, protocol, status, destination_host, path, referer) VALUES (?, 'http', 404, 'alex.flounder.online', '/old.gmi', '-')`,
+		time.Now().Format(time.RFC3339))
+	db.Close()
+	if _, err := checkSiteLinks("alex"); err != nil {
+		t.Fatal(err)
+	}
+	report, err := getBrokenLinks("alex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range report {
+		got = append(got, fmt.Sprintf("%s:%d %s %d", r.Name, r.Line, r.URL, r.Hits))
+	}
+	if want := []string{"a.gmi:2 c.gmi 0", ":0 /old.gmi 1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+	deleteUserFile("alex", "b.gmi")
+	report, _ = checkSiteLinks("alex")
+	if len(report) != 3 {
+		t.Errorf("Link to the deleted page should be reported, got %v", report)
+	}
+}
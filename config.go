@@ -8,6 +8,10 @@ import (
 const HiddenFolder = ".hidden"
 const GemlogFolder = "gemlog"
 
+// Folder in FilesDirectory where writes are staged before being moved into
+// place. It's on the same filesystem, so the move is atomic.
+const TempFolder = ".tmp"
+
 type Config struct {
 	FilesDirectory     string
 	TemplatesDirectory string
@@ -30,10 +34,47 @@ type Config struct {
 	SMTPPassword       string
 	EnableSFTP         bool
 	HostKeyPath        string
+	InlineMedia        bool // let users show media links as images, audio and video
+	// Where user files are kept: "local" (FilesDirectory) or "s3"
+	StorageBackend   string
+	S3Endpoint       string // e.g. https://s3.us-east-1.amazonaws.com
+	S3Bucket         string
+	S3Region         string
+	S3AccessKey      string
+	S3SecretKey      string
+	S3SpoolDirectory string // for uploads on their way to S3, the system's temp folder if empty
+	// Gemini proxy limits
+	ProxyAllowPrivate bool  // allow proxying to private and loopback addresses
+	ProxyMaxBytes     int64 // max size of a proxied response
+	ProxyTimeout      int   // seconds
+	ProxyMaxPerHost   int   // concurrent requests to one origin
+	ProxyCacheEntries int
+	ProxyCacheTTL     int // seconds
+	// Feed reader
+	MaxSubscriptionsPerUser int
+	FeedFetchInterval       int // minutes between fetches of a feed
+	// Send and receive webmentions for links to and from other websites
+	Webmentions bool
+	// Add paths that got 404s to the broken link reports. Needs
+	// AnalyticsDBFile.
+	BrokenLinksFromLog bool
+	// Let users set a stylesheet, favicon, header and footer for their site
+	CustomThemes bool
 }
 
 func getConfig(filename string) (Config, error) {
-	var config Config
+	config := Config{
+		StorageBackend:    "local",
+		ProxyMaxBytes:     5000000,
+		ProxyTimeout:      30,
+		ProxyMaxPerHost:   4,
+		ProxyCacheEntries: 256,
+		ProxyCacheTTL:     60,
+
+		MaxSubscriptionsPerUser: 100,
+		FeedFetchInterval:       60,
+		CustomThemes:            true,
+	}
 	// Attempt to overwrite defaults from file
 	_, err := toml.DecodeFile(filename, &config)
 	if err != nil {
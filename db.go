@@ -4,23 +4,31 @@ import (
 	"crypto/rand"
 	"database/sql"
 	"fmt"
+	"github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/bcrypt"
 	"io"
-	"io/ioutil"
 	"log"
-	"os"
 	"path"
-	"path/filepath"
-	"sort"
 	"strings"
 	"time"
 )
 
 var DB *sql.DB
 
+// The sqlite3 driver with our own SQL functions
+const sqliteDriver = "sqlite3_flounder"
+
+func init() {
+	sql.Register(sqliteDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("search_score", searchScore, true)
+		},
+	})
+}
+
 func initializeDB() {
 	var err error
-	DB, err = sql.Open("sqlite3", c.DBFile)
+	DB, err = sql.Open(sqliteDriver, c.DBFile)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -78,13 +86,16 @@ type File struct { // also folders
 	IsText      bool
 	Children    []File
 	Host        string
+	State       string // draft or scheduled, empty once published
 }
 
 func fileFromPath(fullPath string) File {
-	info, _ := os.Stat(fullPath)
+	var updatedTime time.Time
+	if info, err := store.Stat(fullPath); err == nil {
+		updatedTime = info.ModTime()
+	}
 	creatorFolder := getCreator(fullPath)
 	isText := isTextFile(fullPath)
-	updatedTime := info.ModTime()
 	return File{
 		Name:        getLocalPath(fullPath),
 		Creator:     path.Base(creatorFolder),
@@ -97,18 +108,27 @@ func fileFromPath(fullPath string) File {
 }
 
 type User struct {
-	Username      string
-	Email         string
-	Active        bool
-	Admin         bool
-	CreatedAt     int64 // timestamp
-	Reference     string
-	Domain        string
-	DomainEnabled bool
+	Username        string
+	Email           string
+	Active          bool
+	Admin           bool
+	CreatedAt       int64 // timestamp
+	Reference       string
+	Domain          string
+	DomainEnabled   bool
+	InlineMedia     bool // show media links inline on my site and in the proxy
+	TableOfContents bool // add a table of contents to my pages
+	Listed          bool // show my files and name on the home pages
+	InPlanet        bool // show my gemlog posts on the planet
+	ShowMentions    bool // show pages linking to mine at the end of them
+	Usage           Usage
 }
 
-func getActiveUserNames() ([]string, error) {
-	rows, err := DB.Query(`SELECT username from user WHERE active is true order by username`)
+// Users shown on the home pages. A listed setting in site.toml overrides
+// the one on the account page.
+func getListedUserNames() ([]string, error) {
+	rows, err := DB.Query(`SELECT user.username from user LEFT JOIN site_config ON site_config.username = user.username
+  WHERE active is true AND coalesce(site_config.listed, user.listed) is true order by user.username`)
 	if err != nil {
 		return nil, err
 	}
@@ -148,8 +168,8 @@ func refreshDomainMap() error {
 
 func getUserByName(username string) (*User, error) {
 	var user User
-	row := DB.QueryRow(`SELECT username, email, active, admin, created_at, reference, domain, domain_enabled from user WHERE username = ?`, username)
-	err := row.Scan(&user.Username, &user.Email, &user.Active, &user.Admin, &user.CreatedAt, &user.Reference, &user.Domain, &user.DomainEnabled)
+	row := DB.QueryRow(`SELECT username, email, active, admin, created_at, reference, domain, domain_enabled, inline_media, table_of_contents, listed, in_planet, show_mentions from user WHERE username = ?`, username)
+	err := row.Scan(&user.Username, &user.Email, &user.Active, &user.Admin, &user.CreatedAt, &user.Reference, &user.Domain, &user.DomainEnabled, &user.InlineMedia, &user.TableOfContents, &user.Listed, &user.InPlanet, &user.ShowMentions)
 	if err != nil {
 		return nil, err
 	}
@@ -157,14 +177,17 @@ func getUserByName(username string) (*User, error) {
 }
 
 func getUsers() ([]User, error) {
-	rows, err := DB.Query(`SELECT username, email, active, admin, created_at, reference, domain from user ORDER BY created_at DESC`)
+	rows, err := DB.Query(`SELECT user.username, email, active, admin, created_at, reference, domain,
+  coalesce(bytes, 0), coalesce(files, 0), coalesce(reconciled_at, 0)
+  FROM user LEFT JOIN user_usage ON user.username = user_usage.username ORDER BY created_at DESC`)
 	if err != nil {
 		return nil, err
 	}
 	var users []User
 	for rows.Next() {
 		var user User
-		err = rows.Scan(&user.Username, &user.Email, &user.Active, &user.Admin, &user.CreatedAt, &user.Reference, &user.Domain)
+		err = rows.Scan(&user.Username, &user.Email, &user.Active, &user.Admin, &user.CreatedAt, &user.Reference, &user.Domain,
+			&user.Usage.Bytes, &user.Usage.Files, &user.Usage.ReconciledAt)
 		if err != nil {
 			return nil, err
 		}
@@ -173,38 +196,9 @@ func getUsers() ([]User, error) {
 	return users, nil
 }
 
-func getIndexFiles(admin bool) ([]*File, error) { // cache this function
-	result := []*File{}
-	err := filepath.Walk(c.FilesDirectory, func(thepath string, info os.FileInfo, err error) error {
-		if err != nil {
-			log.Printf("Failure accessing a path %q: %v\n", thepath, err)
-			return err // think about
-		}
-		if !admin && info.IsDir() && info.Name() == HiddenFolder {
-			return filepath.SkipDir
-		}
-		// make this do what it should
-		if !info.IsDir() {
-			res := fileFromPath(thepath)
-			result = append(result, &res)
-		}
-		return nil
-	})
-	if err != nil {
-		return nil, err
-	}
-	sort.Slice(result, func(i, j int) bool {
-		return result[i].UpdatedTime.After(result[j].UpdatedTime)
-	})
-	if len(result) > 50 {
-		result = result[:50]
-	}
-	return result, nil
-} // todo clean up paths
-
 func getMyFilesRecursive(p string, creator string) ([]File, error) {
 	result := []File{}
-	files, err := ioutil.ReadDir(p)
+	files, err := store.ReadDir(p)
 	if err != nil {
 		return nil, err
 	}
@@ -245,12 +239,282 @@ func createTablesIfDNE() {
 		}
 	}
 
+	migrateDB()
+
 	_, err = DB.Exec(`CREATE TABLE IF NOT EXISTS cookie_key (
   value TEXT NOT NULL
 );`)
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	_, err = DB.Exec(`CREATE TABLE IF NOT EXISTS proxy_identity (
+  id INTEGER PRIMARY KEY NOT NULL,
+  username TEXT NOT NULL,
+  hostname TEXT NOT NULL,
+  name TEXT NOT NULL,
+  fingerprint TEXT NOT NULL,
+  certificate BLOB NOT NULL,
+  private_key BLOB NOT NULL,
+  created_at INTEGER DEFAULT (strftime('%s', 'now')),
+  UNIQUE(username, hostname)
+);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = DB.Exec(`CREATE TABLE IF NOT EXISTS proxy_login_token (
+  token TEXT PRIMARY KEY NOT NULL,
+  username TEXT NOT NULL,
+  expires INTEGER NOT NULL
+);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = DB.Exec(`CREATE TABLE IF NOT EXISTS user_usage (
+  username TEXT PRIMARY KEY NOT NULL,
+  bytes INTEGER NOT NULL DEFAULT 0,
+  files INTEGER NOT NULL DEFAULT 0,
+  reconciled_at INTEGER NOT NULL DEFAULT 0
+);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = DB.Exec(`CREATE TABLE IF NOT EXISTS file_index (
+  username TEXT NOT NULL,
+  name TEXT NOT NULL,
+  updated_at INTEGER NOT NULL,
+  PRIMARY KEY (username, name)
+);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = DB.Exec(`CREATE INDEX IF NOT EXISTS file_index_updated_at ON file_index (updated_at)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// username, name and updated_at are stored but not searched
+	_, err = DB.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS search_index USING fts4(
+  username, name, updated_at, title, content,
+  notindexed=username, notindexed=name, notindexed=updated_at, tokenize=unicode61
+);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = DB.Exec(`CREATE TABLE IF NOT EXISTS feed_folder (
+  username TEXT NOT NULL,
+  folder TEXT NOT NULL,
+  title TEXT NOT NULL DEFAULT '',
+  author TEXT NOT NULL DEFAULT '',
+  description TEXT NOT NULL DEFAULT '',
+  PRIMARY KEY (username, folder)
+);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = DB.Exec(`CREATE TABLE IF NOT EXISTS planet_entry (
+  username TEXT NOT NULL,
+  url TEXT NOT NULL,
+  title TEXT NOT NULL,
+  date TEXT NOT NULL,
+  updated_at INTEGER NOT NULL,
+  content TEXT NOT NULL,
+  PRIMARY KEY (username, url)
+);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = DB.Exec(`CREATE INDEX IF NOT EXISTS planet_entry_date ON planet_entry (date, updated_at)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = DB.Exec(`CREATE TABLE IF NOT EXISTS subscription (
+  id INTEGER PRIMARY KEY NOT NULL,
+  username TEXT NOT NULL,
+  url TEXT NOT NULL,
+  title TEXT NOT NULL DEFAULT '',
+  fetched_at INTEGER NOT NULL DEFAULT 0,
+  error TEXT NOT NULL DEFAULT '',
+  created_at INTEGER DEFAULT (strftime('%s', 'now')),
+  UNIQUE (username, url)
+);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = DB.Exec(`CREATE TABLE IF NOT EXISTS subscription_entry (
+  subscription_id INTEGER NOT NULL,
+  entry_id TEXT NOT NULL,
+  url TEXT NOT NULL,
+  title TEXT NOT NULL,
+  published INTEGER NOT NULL,
+  PRIMARY KEY (subscription_id, entry_id)
+);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = DB.Exec(`CREATE INDEX IF NOT EXISTS subscription_entry_published ON subscription_entry (published)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = DB.Exec(`CREATE TABLE IF NOT EXISTS gemini_identity (
+  fingerprint TEXT PRIMARY KEY NOT NULL,
+  username TEXT NOT NULL,
+  created_at INTEGER DEFAULT (strftime('%s', 'now'))
+);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = DB.Exec(`CREATE TABLE IF NOT EXISTS gemini_connect_token (
+  token TEXT PRIMARY KEY NOT NULL,
+  username TEXT NOT NULL,
+  expires INTEGER NOT NULL
+);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = DB.Exec(`CREATE TABLE IF NOT EXISTS file_state (
+  username TEXT NOT NULL,
+  name TEXT NOT NULL,
+  draft boolean NOT NULL DEFAULT false,
+  publish_at INTEGER NOT NULL DEFAULT 0,
+  PRIMARY KEY (username, name)
+);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = DB.Exec(`CREATE TABLE IF NOT EXISTS file_published (
+  username TEXT NOT NULL,
+  name TEXT NOT NULL,
+  published_at INTEGER NOT NULL,
+  PRIMARY KEY (username, name)
+);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = DB.Exec(`CREATE TABLE IF NOT EXISTS broken_link (
+  username TEXT NOT NULL,
+  name TEXT NOT NULL,
+  line INTEGER NOT NULL,
+  url TEXT NOT NULL,
+  reason TEXT NOT NULL,
+  hits INTEGER NOT NULL DEFAULT 0,
+  checked_at INTEGER NOT NULL,
+  PRIMARY KEY (username, name, line, url)
+);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = DB.Exec(`CREATE TABLE IF NOT EXISTS site_theme (
+  username TEXT PRIMARY KEY NOT NULL,
+  stylesheet TEXT NOT NULL DEFAULT '',
+  favicon TEXT NOT NULL DEFAULT '',
+  title_format TEXT NOT NULL DEFAULT '',
+  header TEXT NOT NULL DEFAULT '',
+  footer TEXT NOT NULL DEFAULT ''
+);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The settings are parsed from content, which is kept to show the user
+	_, err = DB.Exec(`CREATE TABLE IF NOT EXISTS site_config (
+  username TEXT PRIMARY KEY NOT NULL,
+  content TEXT NOT NULL DEFAULT '',
+  error TEXT NOT NULL DEFAULT '',
+  title TEXT NOT NULL DEFAULT '',
+  author TEXT NOT NULL DEFAULT '',
+  language TEXT NOT NULL DEFAULT '',
+  description TEXT NOT NULL DEFAULT '',
+  license TEXT NOT NULL DEFAULT '',
+  listed boolean,
+  feed_title TEXT NOT NULL DEFAULT '',
+  feed_description TEXT NOT NULL DEFAULT '',
+  stylesheet TEXT NOT NULL DEFAULT '',
+  favicon TEXT NOT NULL DEFAULT '',
+  title_format TEXT NOT NULL DEFAULT '',
+  header TEXT NOT NULL DEFAULT '',
+  footer TEXT NOT NULL DEFAULT ''
+);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = DB.Exec(`CREATE TABLE IF NOT EXISTS mention (
+  target_username TEXT NOT NULL,
+  target_name TEXT NOT NULL,
+  source_url TEXT NOT NULL,
+  source_username TEXT NOT NULL,
+  source_name TEXT NOT NULL,
+  title TEXT NOT NULL,
+  created_at INTEGER DEFAULT (strftime('%s', 'now')),
+  PRIMARY KEY (target_username, target_name, source_url, source_username, source_name)
+);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = DB.Exec(`CREATE INDEX IF NOT EXISTS mention_source ON mention (source_username, source_name)`)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = DB.Exec(`CREATE TABLE IF NOT EXISTS webmention_sent (
+  source_username TEXT NOT NULL,
+  source_name TEXT NOT NULL,
+  target_url TEXT NOT NULL,
+  created_at INTEGER DEFAULT (strftime('%s', 'now')),
+  PRIMARY KEY (source_username, source_name, target_url)
+);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = DB.Exec(`CREATE TABLE IF NOT EXISTS proxy_known_host (
+  hostname TEXT PRIMARY KEY NOT NULL,
+  fingerprint TEXT NOT NULL,
+  expires INTEGER NOT NULL,
+  created_at INTEGER DEFAULT (strftime('%s', 'now'))
+);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Add columns that were introduced after a table was first created
+func migrateDB() {
+	for _, stmt := range []string{
+		`ALTER TABLE user ADD COLUMN inline_media boolean NOT NULL DEFAULT false`,
+		`ALTER TABLE user ADD COLUMN table_of_contents boolean NOT NULL DEFAULT false`,
+		`ALTER TABLE user ADD COLUMN listed boolean NOT NULL DEFAULT true`,
+		`ALTER TABLE user ADD COLUMN in_planet boolean NOT NULL DEFAULT true`,
+		`ALTER TABLE user ADD COLUMN show_mentions boolean NOT NULL DEFAULT false`,
+	} {
+		_, err := DB.Exec(stmt)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			log.Fatal(err)
+		}
+	}
+}
+
+// Whether links to media should be rendered inline for this user. Needs to
+// be enabled for the instance too.
+func wantsInlineMedia(username string) bool {
+	if !c.InlineMedia || username == "" {
+		return false
+	}
+	var inline bool
+	row := DB.QueryRow("SELECT inline_media FROM user WHERE username = ?", username)
+	err := row.Scan(&inline)
+	if err != nil {
+		return false
+	}
+	return inline
 }
 
 // Generate a cryptographically secure key for the cookie store
@@ -0,0 +1,240 @@
+// Drafts and scheduled publishing. A file with a row in file_state is
+// hidden from visitors, the home page, search and feeds until it's
+// published, when the row is removed.
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/url"
+	"time"
+)
+
+type FileState struct {
+	Draft     bool
+	PublishAt time.Time // when a scheduled file is published
+}
+
+func (s *FileState) String() string {
+	if s.Draft {
+		return "draft"
+	}
+	return "scheduled for " + s.PublishAt.UTC().Format("2006-01-02 15:04") + " UTC"
+}
+
+// The state of a file, nil if it's published
+func getFileState(username string, name string) (*FileState, error) {
+	var s FileState
+	var publishAt int64
+	err := DB.QueryRow("SELECT draft, publish_at FROM file_state WHERE username = ? AND name = ?",
+		username, cleanStorageName(name)).Scan(&s.Draft, &publishAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	s.PublishAt = time.Unix(publishAt, 0)
+	return &s, nil
+}
+
+// The states of a user's unpublished files, by name
+func getFileStates(username string) (map[string]*FileState, error) {
+	rows, err := DB.Query("SELECT name, draft, publish_at FROM file_state WHERE username = ?", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	states := map[string]*FileState{}
+	for rows.Next() {
+		var name string
+		var s FileState
+		var publishAt int64
+		err = rows.Scan(&name, &s.Draft, &publishAt)
+		if err != nil {
+			return nil, err
+		}
+		s.PublishAt = time.Unix(publishAt, 0)
+		states[name] = &s
+	}
+	return states, rows.Err()
+}
+
+// The state chosen on the edit page: "published", "draft" or "scheduled"
+// with a publish_at time in UTC. ok is false if no state was sent.
+func parseFileState(form url.Values) (s *FileState, ok bool) {
+	switch form.Get("state") {
+	case "published":
+		return nil, true
+	case "draft":
+		return &FileState{Draft: true}, true
+	case "scheduled":
+		publishAt, err := time.ParseInLocation("2006-01-02T15:04", form.Get("publish_at"), time.UTC)
+		if err != nil {
+			// Keep it unpublished rather than publish by mistake
+			return &FileState{Draft: true}, true
+		}
+		return &FileState{PublishAt: publishAt}, true
+	}
+	return nil, false
+}
+
+// Whether visitors can see a file. Errors count as unpublished.
+func isPublished(username string, name string) bool {
+	s, err := getFileState(username, name)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return s == nil
+}
+
+// Make a file a draft, schedule it, or with a nil state publish it now.
+// A schedule in the past publishes it too. The file is reindexed so it
+// appears in or disappears from search and feeds.
+func setFileState(username string, name string, s *FileState) error {
+	name = cleanStorageName(name)
+	current, err := getFileState(username, name)
+	if err != nil {
+		return err
+	}
+	publish := s == nil || (!s.Draft && !s.PublishAt.After(time.Now()))
+	if publish && current == nil {
+		return nil
+	} else if !publish && current != nil && current.Draft == s.Draft && current.PublishAt.Unix() == s.PublishAt.Unix() {
+		return nil
+	}
+	if publish {
+		_, err = DB.Exec("DELETE FROM file_state WHERE username = ? AND name = ?", username, name)
+	} else {
+		_, err = DB.Exec("DELETE FROM file_published WHERE username = ? AND name = ?", username, name)
+		if err != nil {
+			return err
+		}
+		_, err = DB.Exec(`INSERT INTO file_state (username, name, draft, publish_at) VALUES (?, ?, ?, ?)
+ON CONFLICT(username, name) DO UPDATE SET draft = excluded.draft, publish_at = excluded.publish_at`,
+			username, name, s.Draft, s.PublishAt.Unix())
+	}
+	if err != nil {
+		return err
+	}
+	return reindexFile(username, name, publish)
+}
+
+// When each of a user's files was last published, by name. Only files
+// published after being a draft or scheduled have one.
+func getPublishTimes(username string) (map[string]int64, error) {
+	rows, err := DB.Query("SELECT name, published_at FROM file_published WHERE username = ?", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	times := map[string]int64{}
+	for rows.Next() {
+		var name string
+		var publishedAt int64
+		err = rows.Scan(&name, &publishedAt)
+		if err != nil {
+			return nil, err
+		}
+		times[name] = publishedAt
+	}
+	return times, rows.Err()
+}
+
+// Index a file again after its state changed. Publishing counts as an
+// update, so the file shows up on the home page. The time is kept, so
+// reindexing the user's files later doesn't undo it.
+func reindexFile(username string, name string, published bool) error {
+	fullPath := userFilePath(username, name)
+	info, err := store.Stat(fullPath)
+	if err != nil || info.IsDir() {
+		// Not written yet
+		return nil
+	}
+	var content []byte
+	if isSearchable(name) {
+		content, err = readStorageFile(fullPath)
+		if err != nil {
+			return err
+		}
+	}
+	updated := info.ModTime()
+	if published {
+		updated = time.Now()
+		_, err = DB.Exec(`INSERT INTO file_published (username, name, published_at) VALUES (?, ?, ?)
+ON CONFLICT(username, name) DO UPDATE SET published_at = excluded.published_at`,
+			username, name, updated.Unix())
+		if err != nil {
+			return err
+		}
+	}
+	return indexFile(username, name, updated, content)
+}
+
+// Publish the files whose time has come
+func publishScheduledFiles() error {
+	rows, err := DB.Query("SELECT username, name FROM file_state WHERE NOT draft AND publish_at <= ?", time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	type file struct{ username, name string }
+	var due []file
+	for rows.Next() {
+		var f file
+		err = rows.Scan(&f.username, &f.name)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, f)
+	}
+	rows.Close()
+	for _, f := range due {
+		err = publishScheduledFile(f.username, f.name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func publishScheduledFile(username string, name string) error {
+	unlock := lockUser(username)
+	defer unlock()
+	// It may have been edited or deleted since it was found
+	res, err := DB.Exec("DELETE FROM file_state WHERE username = ? AND name = ? AND NOT draft AND publish_at <= ?",
+		username, name, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	err = reindexFile(username, name, true)
+	if err != nil {
+		return err
+	}
+	log.Printf("Published %s/%s", username, name)
+	return nil
+}
+
+func publishWorker() {
+	log.Println("Starting scheduled publishing worker")
+	for {
+		err := publishScheduledFiles()
+		if err != nil {
+			log.Println(err)
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+// Set the state shown on the my_site page of each file
+func markFileStates(files []File, states map[string]*FileState) {
+	for i := range files {
+		if s := states[files[i].Name]; s != nil {
+			files[i].State = s.String()
+		}
+		markFileStates(files[i].Children, states)
+	}
+}
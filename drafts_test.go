@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDrafts(t *testing.T) {
+	defer setupStorageTest(t)()
+	addTestUser(t, "alex", true)
+	visible := func() (files []string, results int, entries int) {
+		t.Helper()
+		index, _, err := getIndexFiles(false, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range index {
+			files = append(files, f.Name)
+		}
+		found, err := searchFiles("secret", "alex")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return files, len(found), len(generateFeedFromUser("alex").Entries)
+	}
+	setFileState("alex", "gemlog/2021-01-02-a.gmi", &FileState{Draft: true})
+	writeUserFile("alex", "gemlog/2021-01-02-a.gmi", strings.NewReader("# A secret"))
+	if files, results, entries := visible(); len(files)+results+entries != 0 {
+		t.Errorf("Draft is visible: %v, %d search results, %d feed entries", files, results, entries)
+	}
+	renameUserFile("alex", "gemlog/2021-01-02-a.gmi", "gemlog/2021-01-03-a.gmi")
+	if isPublished("alex", "gemlog/2021-01-03-a.gmi") {
+		t.Errorf("Renamed draft was published")
+	}
+	setFileState("alex", "gemlog/2021-01-03-a.gmi", &FileState{PublishAt: time.Now().Add(time.Hour)})
+	if err := publishScheduledFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if isPublished("alex", "gemlog/2021-01-03-a.gmi") {
+		t.Errorf("File was published before its time")
+	}
+	DB.Exec("UPDATE file_state SET publish_at = 0")
+	if err := publishScheduledFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if files, results, entries := visible(); len(files) != 1 || results != 1 || entries != 1 {
+		t.Errorf("Published file isn't visible: %v, %d search results, %d feed entries", files, results, entries)
+	}
+	// Reindexing keeps the publish time rather than the older file's
+	os.Chtimes(path.Join(c.FilesDirectory, "alex", "gemlog/2021-01-03-a.gmi"), time.Unix(1000, 0), time.Unix(1000, 0))
+	if err := reindexUserFiles("alex"); err != nil {
+		t.Fatal(err)
+	}
+	var updated int64
+	DB.QueryRow("SELECT updated_at FROM file_index WHERE name = 'gemlog/2021-01-03-a.gmi'").Scan(&updated)
+	if time.Since(time.Unix(updated, 0)) > time.Minute {
+		t.Errorf("Publish time was lost when reindexing, got %v", time.Unix(updated, 0))
+	}
+}
@@ -0,0 +1,103 @@
+// EPUB export of a user's gemlog, with a chapter per post
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	gmi "git.sr.ht/~adnano/go-gemini"
+)
+
+const epubContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+
+const epubChapter = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>%s</title></head>
+<body>
+%s</body>
+</html>
+`
+
+// The language is a BCP 47 tag, e.g. from the site's site.toml
+func buildEpub(feed *Gemfeed, language string, w io.Writer) error {
+	z := zip.NewWriter(w)
+	// The mimetype must come first and be stored uncompressed
+	f, err := z.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		return err
+	}
+	io.WriteString(f, "application/epub+zip")
+	f, err = z.Create("META-INF/container.xml")
+	if err != nil {
+		return err
+	}
+	io.WriteString(f, epubContainer)
+
+	renderer := newHTMLRenderer(nil)
+	renderer.XHTML = true
+	renderer.Scheme = "https"
+	var manifest, spine, nav strings.Builder
+	// Entries are newest first, a book reads oldest first
+	for i := len(feed.Entries) - 1; i >= 0; i-- {
+		entry := feed.Entries[i]
+		name := fmt.Sprintf("chapter%d.xhtml", len(feed.Entries)-i)
+		parse, err := gmi.ParseText(strings.NewReader(entry.Content))
+		if err != nil {
+			return err
+		}
+		// Resolve relative links against the post
+		renderer.BaseURL = &url.URL{Scheme: "gemini", Host: entry.Url.Host, Path: entry.Url.Path}
+		doc := renderer.Render(parse)
+		title := html.EscapeString(entry.DateString + " " + entry.Title)
+		f, err = z.Create("OEBPS/" + name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(f, epubChapter, title, doc.Content)
+		fmt.Fprintf(&manifest, "    <item id=\"%s\" href=\"%s\" media-type=\"application/xhtml+xml\"/>\n", name, name)
+		fmt.Fprintf(&spine, "    <itemref idref=\"%s\"/>\n", name)
+		fmt.Fprintf(&nav, "    <li><a href=\"%s\">%s</a></li>\n", name, title)
+	}
+
+	f, err = z.Create("OEBPS/nav.xhtml")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(f, epubChapter, "Contents",
+		"<nav epub:type=\"toc\">\n  <h1>Contents</h1>\n  <ol>\n"+nav.String()+"  </ol>\n</nav>\n")
+
+	f, err = z.Create("OEBPS/content.opf")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(f, `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">%s</dc:identifier>
+    <dc:title>%s</dc:title>
+    <dc:creator>%s</dc:creator>
+    <dc:language>%s</dc:language>
+    <meta property="dcterms:modified">%s</meta>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+%s  </manifest>
+  <spine>
+%s  </spine>
+</package>
+`, html.EscapeString("gemini:"+feed.Url.String()), html.EscapeString(feed.Title), html.EscapeString(feed.Creator),
+		html.EscapeString(language), time.Now().UTC().Format("2006-01-02T15:04:05Z"), manifest.String(), spine.String())
+	return z.Close()
+}
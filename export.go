@@ -0,0 +1,165 @@
+// Converters from gemtext to other formats, for exporting pages
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"git.sr.ht/~adnano/go-gemini"
+)
+
+// Characters that have a meaning in Markdown text
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", `*`, `\*`, `_`, `\_`, `[`, `\[`, `]`, `\]`,
+	`<`, `\<`, `>`, `\>`, `#`, `\#`,
+)
+
+var markdownURLEscaper = strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29")
+
+func escapeMarkdown(s string) string {
+	s = markdownEscaper.Replace(s)
+	// A leading "1." or "-" would start a list
+	if len(s) > 0 && (s[0] == '-' || s[0] == '+') {
+		s = `\` + s
+	}
+	for i, r := range s {
+		if r < '0' || r > '9' {
+			if i > 0 && r == '.' {
+				s = s[:i] + `\` + s[i:]
+			}
+			break
+		}
+	}
+	return s
+}
+
+type MarkdownRenderer struct{}
+
+// Each gemtext line is its own block in Markdown. Consecutive list items,
+// quotes and preformatted lines are grouped into one block.
+func (MarkdownRenderer) Render(text gemini.Text) ConvertedGmiDoc {
+	var blocks []string
+	var block strings.Builder
+	var pre bool
+	var title string
+	var prev gemini.Line
+	flush := func() {
+		if block.Len() > 0 {
+			blocks = append(blocks, strings.TrimSuffix(block.String(), "\n"))
+			block.Reset()
+		}
+	}
+	for _, l := range text {
+		_, isList := l.(gemini.LineListItem)
+		_, wasList := prev.(gemini.LineListItem)
+		_, isQuote := l.(gemini.LineQuote)
+		_, wasQuote := prev.(gemini.LineQuote)
+		if !(isList && wasList) && !(isQuote && wasQuote) && !pre {
+			flush()
+		}
+		prev = l
+		switch l := l.(type) {
+		case gemini.LineLink:
+			name := l.Name
+			if name == "" {
+				fmt.Fprintf(&block, "<%s>\n", l.URL)
+			} else {
+				fmt.Fprintf(&block, "[%s](%s)\n", escapeMarkdown(name), markdownURLEscaper.Replace(l.URL))
+			}
+		case gemini.LinePreformattingToggle:
+			pre = !pre
+			fmt.Fprint(&block, "```\n")
+			if !pre {
+				flush()
+			}
+		case gemini.LinePreformattedText:
+			fmt.Fprintf(&block, "%s\n", string(l))
+		case gemini.LineHeading1:
+			fmt.Fprintf(&block, "# %s\n", escapeMarkdown(string(l)))
+			if title == "" {
+				title = string(l)
+			}
+		case gemini.LineHeading2:
+			fmt.Fprintf(&block, "## %s\n", escapeMarkdown(string(l)))
+			if title == "" {
+				title = string(l)
+			}
+		case gemini.LineHeading3:
+			fmt.Fprintf(&block, "### %s\n", escapeMarkdown(string(l)))
+			if title == "" {
+				title = string(l)
+			}
+		case gemini.LineListItem:
+			fmt.Fprintf(&block, "* %s\n", escapeMarkdown(string(l)))
+		case gemini.LineQuote:
+			if wasQuote {
+				fmt.Fprint(&block, ">\n")
+			}
+			fmt.Fprintf(&block, "> %s\n", escapeMarkdown(string(l)))
+		case gemini.LineText:
+			// Blank lines are just spacing between blocks
+			if l != "" {
+				fmt.Fprintf(&block, "%s\n", escapeMarkdown(string(l)))
+			}
+		}
+	}
+	if pre {
+		fmt.Fprint(&block, "```\n")
+	}
+	flush()
+	return ConvertedGmiDoc{strings.Join(blocks, "\n\n") + "\n", title}
+}
+
+type TextRenderer struct{}
+
+// Strips the markup, keeping link URLs next to their names
+func (TextRenderer) Render(text gemini.Text) ConvertedGmiDoc {
+	var b strings.Builder
+	var title string
+	for _, l := range text {
+		switch l := l.(type) {
+		case gemini.LineLink:
+			if l.Name == "" {
+				fmt.Fprintf(&b, "%s\n", l.URL)
+			} else {
+				fmt.Fprintf(&b, "%s <%s>\n", l.Name, l.URL)
+			}
+		case gemini.LinePreformattingToggle:
+		case gemini.LinePreformattedText:
+			fmt.Fprintf(&b, "%s\n", string(l))
+		case gemini.LineHeading1:
+			fmt.Fprintf(&b, "%s\n%s\n", string(l), strings.Repeat("=", len([]rune(string(l)))))
+			if title == "" {
+				title = string(l)
+			}
+		case gemini.LineHeading2:
+			fmt.Fprintf(&b, "%s\n%s\n", string(l), strings.Repeat("-", len([]rune(string(l)))))
+			if title == "" {
+				title = string(l)
+			}
+		case gemini.LineHeading3:
+			fmt.Fprintf(&b, "%s\n", string(l))
+			if title == "" {
+				title = string(l)
+			}
+		case gemini.LineListItem:
+			fmt.Fprintf(&b, "- %s\n", string(l))
+		case gemini.LineQuote:
+			fmt.Fprintf(&b, "  %s\n", string(l))
+		case gemini.LineText:
+			fmt.Fprintf(&b, "%s\n", string(l))
+		}
+	}
+	return ConvertedGmiDoc{b.String(), title}
+}
+
+// Renderer for the ?format= query parameter on user pages
+func exportRenderer(format string) (Renderer, string) {
+	switch format {
+	case "md":
+		return MarkdownRenderer{}, "text/markdown; charset=utf-8"
+	case "txt":
+		return TextRenderer{}, "text/plain; charset=utf-8"
+	}
+	return nil, ""
+}
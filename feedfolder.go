@@ -0,0 +1,140 @@
+// Folders users have marked as feeds, with their own title, author and
+// description. Each gets a generated index page if it has no index.gmi, and
+// Atom, RSS and JSON feeds. The gemlog folder is always a feed.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path"
+	"strings"
+)
+
+const maxFeedFolders = 20
+
+type FeedFolder struct {
+	Folder      string
+	Title       string // empty to use the index page heading or a default
+	Author      string // empty for the username
+	Description string
+}
+
+// Feed files generated in feed folders, unless the user has their own
+var feedFiles = map[string]string{
+	"atom.xml":  "atom",
+	"rss.xml":   "rss",
+	"feed.json": "json",
+}
+
+// The user's feed folders, gemlog included
+func getFeedFolders(username string) ([]FeedFolder, error) {
+	rows, err := DB.Query("SELECT folder, title, author, description FROM feed_folder WHERE username = ? ORDER BY folder", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	folders := []FeedFolder{}
+	hasGemlog := false
+	for rows.Next() {
+		var f FeedFolder
+		err = rows.Scan(&f.Folder, &f.Title, &f.Author, &f.Description)
+		if err != nil {
+			return nil, err
+		}
+		hasGemlog = hasGemlog || f.Folder == GemlogFolder
+		folders = append(folders, f)
+	}
+	if !hasGemlog {
+		folders = append([]FeedFolder{{Folder: GemlogFolder}}, folders...)
+	}
+	return folders, rows.Err()
+}
+
+// The settings for a folder, or nil if it isn't a feed
+func getFeedFolder(username string, folder string) (*FeedFolder, error) {
+	f := FeedFolder{Folder: cleanStorageName(folder)}
+	row := DB.QueryRow("SELECT title, author, description FROM feed_folder WHERE username = ? AND folder = ?", username, f.Folder)
+	err := row.Scan(&f.Title, &f.Author, &f.Description)
+	if err == sql.ErrNoRows {
+		if f.Folder == GemlogFolder {
+			return &f, nil
+		}
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// Mark a folder as a feed, or change its settings
+func setFeedFolder(username string, f FeedFolder) error {
+	f.Folder = cleanStorageName(f.Folder)
+	if f.Folder == "" || inHiddenFolder(f.Folder) {
+		return fmt.Errorf("Invalid feed folder")
+	}
+	if len(f.Title) > 200 || len(f.Author) > 200 || len(f.Description) > 1000 {
+		return fmt.Errorf("Feed title, author or description too long")
+	}
+	existing, err := getFeedFolders(username)
+	if err != nil {
+		return err
+	}
+	isNew := true
+	for _, e := range existing {
+		isNew = isNew && e.Folder != f.Folder
+	}
+	if isNew && len(existing) >= maxFeedFolders {
+		return fmt.Errorf("You can have at most %d feeds", maxFeedFolders)
+	}
+	_, err = DB.Exec(`INSERT INTO feed_folder (username, folder, title, author, description) VALUES (?, ?, ?, ?, ?)
+ON CONFLICT(username, folder) DO UPDATE SET title = excluded.title, author = excluded.author, description = excluded.description`,
+		username, f.Folder, strings.TrimSpace(f.Title), strings.TrimSpace(f.Author), strings.TrimSpace(f.Description))
+	return err
+}
+
+// Stop a folder being a feed. The gemlog goes back to its defaults.
+func deleteFeedFolder(username string, folder string) error {
+	_, err := DB.Exec("DELETE FROM feed_folder WHERE username = ? AND folder = ?", username, cleanStorageName(folder))
+	return err
+}
+
+// Keep feed settings with a folder when it, or a folder it's in, is renamed
+func renameFeedFolder(username string, oldName string, newName string) error {
+	oldName, newName = cleanStorageName(oldName), cleanStorageName(newName)
+	_, err := DB.Exec(`UPDATE OR IGNORE feed_folder SET folder = ? || substr(folder, ?) WHERE username = ? AND (folder = ? OR substr(folder, 1, ?) = ?)`,
+		newName, len(oldName)+1, username, oldName, len(oldName)+1, oldName+"/")
+	return err
+}
+
+// Settings override what's in the index page
+func (f *FeedFolder) apply(feed *Gemfeed) {
+	if f.Title != "" {
+		feed.Title = f.Title
+	}
+	if f.Author != "" {
+		feed.Creator = f.Author
+	}
+	if f.Description != "" {
+		feed.Subtitle = f.Description
+	}
+}
+
+// Default title for a feed, e.g. "Alex's Gemlog", or from the site's title
+// if it has one
+func defaultFeedTitle(username string, folder string) string {
+	folder = cleanStorageName(folder)
+	name := path.Base(folder)
+	if name == "." || name == "/" || folder == "" {
+		name = "site"
+	}
+	site := getSiteConfig(username)
+	switch {
+	case folder == GemlogFolder && site.Feed.Title != "":
+		return site.Feed.Title
+	case site.Title != "" && (folder == GemlogFolder || name == "site"):
+		return site.Title
+	case site.Title != "":
+		return site.Title + ": " + strings.Title(name)
+	}
+	return strings.Title(username) + "'s " + strings.Title(name)
+}
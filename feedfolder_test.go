@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFeedFolders(t *testing.T) {
+	defer setupStorageTest(t)()
+	c.OkExtensions = append(c.OkExtensions, "")
+	writeUserFile("alex", "notes/2021-02-03-b.gmi", strings.NewReader("# B"))
+	writeUserFile("alex", "notes/2021-01-02-a.gmi", strings.NewReader("# A"))
+	if folder, _ := getFeedFolder("alex", "notes"); folder != nil {
+		t.Fatal("Folders aren't feeds until they're marked")
+	}
+	if folder, _ := getFeedFolder("alex", "/gemlog/"); folder == nil {
+		t.Fatal("The gemlog is always a feed")
+	}
+	err := setFeedFolder("alex", FeedFolder{Folder: "/notes/", Description: "Short ones"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = setFeedFolder("alex", FeedFolder{Folder: HiddenFolder}); err == nil {
+		t.Error("Hidden folders shouldn't be feeds")
+	}
+	renameUserFile("alex", "notes", "jottings")
+	folder, _ := getFeedFolder("alex", "jottings")
+	if folder == nil {
+		t.Fatal("Feed settings didn't follow the folder")
+	}
+	feed := generateFeedFromFolder("alex", folder)
+	if feed.Title != "Alex's Jottings" || feed.Subtitle != "Short ones" || len(feed.Entries) != 2 || feed.Entries[0].Title != "B" {
+		t.Errorf("Got feed %q %q with %d entries", feed.Title, feed.Subtitle, len(feed.Entries))
+	}
+	folders, _ := getFeedFolders("alex")
+	if len(folders) != 2 || folders[0].Folder != GemlogFolder {
+		t.Errorf("Got feed folders %v", folders)
+	}
+}
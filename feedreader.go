@@ -0,0 +1,721 @@
+// The feed reader: users subscribe to gemlogs on this instance, Gemini
+// subscription pages elsewhere, and Atom or RSS feeds. A background worker
+// fetches them and keeps their entries for each user's timeline.
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	gmi "git.sr.ht/~adnano/go-gemini"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// Entries kept for each subscription
+const maxSubscriptionEntries = 200
+
+type Subscription struct {
+	ID        int64
+	Username  string
+	URL       string
+	Title     string
+	FetchedAt int64  // timestamp
+	Error     string // from the last fetch
+}
+
+// Parse what a user typed as a feed URL. Gemini is assumed without a scheme.
+func parseFeedURL(raw string) (*url.URL, error) {
+	raw = strings.TrimSpace(raw)
+	if !strings.Contains(raw, "://") {
+		raw = "gemini://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || (u.Scheme != "gemini" && u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("Invalid feed URL, use a gemini://, http:// or https:// URL")
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	u.Fragment = ""
+	return u, nil
+}
+
+func getSubscriptions(username string) ([]Subscription, error) {
+	rows, err := DB.Query(`SELECT id, username, url, title, fetched_at, error FROM subscription
+  WHERE username = ? ORDER BY lower(title), url`, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	subs := []Subscription{}
+	for rows.Next() {
+		var s Subscription
+		err = rows.Scan(&s.ID, &s.Username, &s.URL, &s.Title, &s.FetchedAt, &s.Error)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+	return subs, rows.Err()
+}
+
+// Wakes the worker up to fetch new subscriptions
+var newSubscription = make(chan struct{}, 1)
+
+// Subscribe to a feed. The worker fetches it for the first time.
+func addSubscription(username string, raw string) error {
+	u, err := parseFeedURL(raw)
+	if err != nil {
+		return err
+	}
+	var count int
+	err = DB.QueryRow("SELECT count(*) FROM subscription WHERE username = ?", username).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count >= c.MaxSubscriptionsPerUser {
+		return fmt.Errorf("You can follow at most %d feeds", c.MaxSubscriptionsPerUser)
+	}
+	res, err := DB.Exec("INSERT OR IGNORE INTO subscription (username, url) VALUES (?, ?)", username, u.String())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("You already follow %s", u.String())
+	}
+	select {
+	case newSubscription <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func deleteSubscription(username string, id int64) error {
+	res, err := DB.Exec("DELETE FROM subscription WHERE id = ? AND username = ?", id, username)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+	_, err = DB.Exec("DELETE FROM subscription_entry WHERE subscription_id = ?", id)
+	return err
+}
+
+// Store the result of fetching a subscription
+func updateSubscription(s Subscription, feed *Gemfeed, fetchErr error) error {
+	now := time.Now()
+	if fetchErr != nil {
+		_, err := DB.Exec("UPDATE subscription SET fetched_at = ?, error = ? WHERE id = ?", now.Unix(), fetchErr.Error(), s.ID)
+		return err
+	}
+	title := feed.Title
+	if title == "" {
+		title = s.URL
+	}
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE subscription SET fetched_at = ?, error = '', title = ? WHERE id = ?", now.Unix(), title, s.ID)
+	for _, e := range feed.Entries {
+		if err != nil {
+			break
+		}
+		published := e.Date
+		if published.IsZero() {
+			published = e.Updated
+		}
+		if published.IsZero() || published.After(now) {
+			published = now
+		}
+		_, err = tx.Exec(`INSERT INTO subscription_entry (subscription_id, entry_id, url, title, published)
+VALUES (?, ?, ?, ?, ?)
+ON CONFLICT(subscription_id, entry_id) DO UPDATE SET url = excluded.url, title = excluded.title`,
+			s.ID, e.Id(), e.Url.String(), e.Title, published.Unix())
+	}
+	if err == nil {
+		_, err = tx.Exec(`DELETE FROM subscription_entry WHERE subscription_id = ? AND entry_id NOT IN
+  (SELECT entry_id FROM subscription_entry WHERE subscription_id = ? ORDER BY published DESC LIMIT ?)`,
+			s.ID, s.ID, maxSubscriptionEntries)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Fetch subscriptions that are due. Each URL is fetched once however many
+// users follow it.
+func refreshSubscriptions() {
+	due := time.Now().Add(-time.Duration(c.FeedFetchInterval) * time.Minute).Unix()
+	rows, err := DB.Query("SELECT id, username, url FROM subscription WHERE fetched_at < ? ORDER BY url", due)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	var subs []Subscription
+	for rows.Next() {
+		var s Subscription
+		err = rows.Scan(&s.ID, &s.Username, &s.URL)
+		if err != nil {
+			log.Println(err)
+			break
+		}
+		subs = append(subs, s)
+	}
+	rows.Close()
+	var lastURL string
+	var feed *Gemfeed
+	var fetchErr error
+	for _, s := range subs {
+		if s.URL != lastURL {
+			lastURL = s.URL
+			u, err := url.Parse(s.URL)
+			if err != nil {
+				feed, fetchErr = nil, err
+			} else {
+				feed, fetchErr = fetchFeed(u)
+			}
+		}
+		err = updateSubscription(s, feed, fetchErr)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func subscriptionWorker() {
+	log.Println("Starting feed reader worker")
+	for {
+		refreshSubscriptions()
+		select {
+		case <-newSubscription:
+		case <-time.After(5 * time.Minute):
+		}
+	}
+}
+
+// A user's timeline, newest first, a page at a time. Pages start at 1.
+func getTimeline(username string, page int) ([]FeedEntry, bool, error) {
+	if page < 1 {
+		page = 1
+	}
+	rows, err := DB.Query(`SELECT subscription.title, subscription.url, subscription_entry.url, subscription_entry.title, published
+  FROM subscription_entry JOIN subscription ON subscription.id = subscription_entry.subscription_id
+  WHERE subscription.username = ?
+  ORDER BY published DESC LIMIT ? OFFSET ?`, username, indexPageSize+1, (page-1)*indexPageSize)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	feeds := map[string]*Gemfeed{}
+	entries := []FeedEntry{}
+	for rows.Next() {
+		var e FeedEntry
+		var feedTitle, feedURL, link string
+		var published int64
+		err = rows.Scan(&feedTitle, &feedURL, &link, &e.Title, &published)
+		if err != nil {
+			return nil, false, err
+		}
+		e.Url, err = url.Parse(link)
+		if err != nil {
+			continue
+		}
+		e.Date = time.Unix(published, 0)
+		e.DateString = e.Date.Format("2006-01-02")
+		if feeds[feedURL] == nil {
+			u, _ := url.Parse(feedURL)
+			feeds[feedURL] = &Gemfeed{Title: feedTitle, Url: u}
+		}
+		e.Feed = feeds[feedURL]
+		entries = append(entries, e)
+	}
+	hasMore := len(entries) > indexPageSize
+	if hasMore {
+		entries = entries[:indexPageSize]
+	}
+	return entries, hasMore, rows.Err()
+}
+
+// Link to an entry from a web page: pages on this instance directly, other
+// Gemini pages through the proxy
+func (fe FeedEntry) WebURL() string {
+	u := *fe.Url
+	if u.Scheme == "gemini" || u.Scheme == "" {
+		u.Scheme = ""
+		if !isFlounderHost(u.Host) {
+			u.Path = "/" + u.Host + u.Path
+			u.Host = "proxy." + c.Host
+		}
+	}
+	return u.String()
+}
+
+func fetchFeed(u *url.URL) (*Gemfeed, error) {
+	if feed, ok := localFeed(u); ok {
+		if feed == nil {
+			return nil, fmt.Errorf("Not found")
+		}
+		return feed, nil
+	}
+	if u.Scheme == "gemini" {
+		return fetchGeminiFeed(u)
+	}
+	return fetchHTTPFeed(u)
+}
+
+// Feeds on this instance are read straight from storage
+func localFeed(u *url.URL) (*Gemfeed, bool) {
+	if u.Scheme != "gemini" && u.Scheme != "http" && u.Scheme != "https" {
+		return nil, false
+	}
+	username := userFromHost(u.Hostname())
+	if username == "" {
+		return nil, false
+	}
+	user, err := getUserByName(username)
+	if err != nil || !user.Active {
+		return nil, true
+	}
+	p := path.Clean("/" + u.Path)
+	if inHiddenFolder(p) {
+		return nil, true
+	}
+	if dir, base := path.Split(p); feedFiles[base] != "" {
+		p = dir
+	}
+	if folder, _ := getFeedFolder(username, p); folder != nil {
+		return generateFeedFromFolder(username, folder), true
+	}
+	fullPath := path.Join(getUserDirectory(username), p)
+	if info, err := store.Stat(fullPath); err == nil && info.IsDir() {
+		fullPath = path.Join(fullPath, "index.gmi")
+	}
+	if !isGemini(fullPath) {
+		return nil, true
+	}
+	content, err := readStorageFile(fullPath)
+	if err != nil {
+		return nil, true
+	}
+	text, err := gmi.ParseText(bytes.NewReader(content))
+	if err != nil {
+		return nil, true
+	}
+	return generateFeedFromPage(username, fullPath, text), true
+}
+
+// Fetch over Gemini with the proxy's limits, following a few redirects
+func fetchGeminiFeed(u *url.URL) (*Gemfeed, error) {
+	for redirects := 0; redirects < 5; redirects++ {
+		req := gmi.Request{URL: u, Host: u.Host}
+		if u.Port() == "" {
+			req.Host += ":1965"
+		}
+		resp, err := fetchGemini(&req)
+		if err != nil {
+			return nil, err
+		}
+		switch resp.Status / 10 {
+		case 2:
+			return parseFeedBody(resp.Body, resp.Meta, u)
+		case 3:
+			next, err := url.Parse(resp.Meta)
+			if err != nil {
+				return nil, err
+			}
+			u = u.ResolveReference(next)
+			if u.Scheme != "gemini" {
+				return nil, fmt.Errorf("Redirected to %s", u)
+			}
+		default:
+			return nil, fmt.Errorf("Server returned %d %s", resp.Status, resp.Meta)
+		}
+	}
+	return nil, fmt.Errorf("Too many redirects")
+}
+
+func fetchHTTPFeed(u *url.URL) (*Gemfeed, error) {
+	client := guardedHTTPClient()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "flounder feed reader (+https://"+c.Host+")")
+	req.Header.Set("Accept", "application/atom+xml, application/rss+xml, application/xml;q=0.9, text/xml;q=0.9, text/gemini;q=0.8")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Server returned %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, c.ProxyMaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > c.ProxyMaxBytes {
+		return nil, fmt.Errorf("Feed is larger than the %d byte limit", c.ProxyMaxBytes)
+	}
+	return parseFeedBody(body, resp.Header.Get("Content-Type"), resp.Request.URL)
+}
+
+// Gemtext is read as a subscription page, anything else as Atom or RSS
+func parseFeedBody(body []byte, contentType string, base *url.URL) (*Gemfeed, error) {
+	m, params, _ := mime.ParseMediaType(contentType)
+	if m == "text/gemini" {
+		body, err := decodeCharset(body, params["charset"])
+		if err != nil {
+			return nil, err
+		}
+		text, err := gmi.ParseText(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		return parseGemfeed(text, base), nil
+	}
+	return parseXMLFeed(body, base)
+}
+
+type xmlLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Text string `xml:",chardata"`
+}
+
+type xmlEntry struct {
+	Title     string    `xml:"title"`
+	ID        string    `xml:"id"`
+	GUID      string    `xml:"guid"`
+	Links     []xmlLink `xml:"link"`
+	Published string    `xml:"published"`
+	Updated   string    `xml:"updated"`
+	PubDate   string    `xml:"pubDate"`
+	Date      string    `xml:"date"` // Dublin Core, common in RSS
+}
+
+type xmlChannel struct {
+	Title       string     `xml:"title"`
+	Subtitle    string     `xml:"subtitle"`
+	Description string     `xml:"description"`
+	Entries     []xmlEntry `xml:"entry"`
+	Items       []xmlEntry `xml:"item"`
+}
+
+// Both Atom's feed element and RSS's rss element
+type xmlFeed struct {
+	xmlChannel
+	Channel *xmlChannel `xml:"channel"`
+	Items   []xmlEntry  `xml:"item"` // RSS 1.0 items are outside the channel
+}
+
+var feedTimeLayouts = []string{
+	time.RFC3339,
+	time.RFC1123Z,
+	time.RFC1123,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	"2006-01-02",
+}
+
+func parseFeedTime(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, layout := range feedTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// Parse an Atom or RSS feed
+func parseXMLFeed(body []byte, base *url.URL) (*Gemfeed, error) {
+	var doc xmlFeed
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	decoder.Strict = false
+	decoder.CharsetReader = func(label string, input io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(label)
+		if err != nil {
+			return nil, err
+		}
+		return enc.NewDecoder().Reader(input), nil
+	}
+	err := decoder.Decode(&doc)
+	if err != nil {
+		return nil, fmt.Errorf("Not a Gemini, Atom or RSS feed: %v", err)
+	}
+	channel := doc.xmlChannel
+	if doc.Channel != nil {
+		channel = *doc.Channel
+	}
+	items := append(append(channel.Entries, channel.Items...), doc.Items...)
+	feed := Gemfeed{
+		Title:    strings.TrimSpace(channel.Title),
+		Subtitle: strings.TrimSpace(channel.Subtitle + channel.Description),
+		Url:      base,
+	}
+	for _, item := range items {
+		var link string
+		for _, l := range item.Links {
+			href := strings.TrimSpace(l.Href + l.Text)
+			if href != "" && (link == "" || l.Rel == "" || l.Rel == "alternate") {
+				link = href
+			}
+		}
+		if link == "" && strings.Contains(item.GUID, "://") {
+			link = item.GUID
+		}
+		u, err := url.Parse(link)
+		if err != nil || link == "" {
+			continue
+		}
+		entry := FeedEntry{
+			Title: strings.TrimSpace(item.Title),
+			Url:   base.ResolveReference(u),
+			Guid:  strings.TrimSpace(item.ID + item.GUID),
+			Feed:  &feed,
+		}
+		entry.Updated = parseFeedTime(item.Updated)
+		for _, date := range []string{item.Published, item.PubDate, item.Date, item.Updated} {
+			if entry.Date = parseFeedTime(date); !entry.Date.IsZero() {
+				break
+			}
+		}
+		if !entry.Date.IsZero() {
+			entry.DateString = entry.Date.Format("2006-01-02")
+		}
+		if entry.Title == "" {
+			entry.Title = entry.Url.String()
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	if len(feed.Entries) == 0 && feed.Title == "" {
+		return nil, fmt.Errorf("Not a Gemini, Atom or RSS feed")
+	}
+	sortFeed(&feed)
+	return &feed, nil
+}
+
+// Client certificates users have connected to their account, to read their
+// timeline over Gemini
+func getGeminiIdentityUser(fingerprint string) (string, error) {
+	var username string
+	err := DB.QueryRow("SELECT username FROM gemini_identity WHERE fingerprint = ?", fingerprint).Scan(&username)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return username, err
+}
+
+// Single use token that connects the client certificate it's presented with
+// to the user's account
+func createGeminiConnectToken(username string) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	expires := time.Now().Add(5 * time.Minute).Unix()
+	_, err = DB.Exec("INSERT INTO gemini_connect_token (token, username, expires) VALUES (?, ?, ?)", token, username, expires)
+	return token, err
+}
+
+func consumeGeminiConnectToken(token string) (string, error) {
+	var username string
+	var expires int64
+	err := DB.QueryRow("SELECT username, expires FROM gemini_connect_token WHERE token = ?", token).Scan(&username, &expires)
+	if err != nil {
+		return "", fmt.Errorf("Invalid connection token")
+	}
+	_, err = DB.Exec("DELETE FROM gemini_connect_token WHERE token = ? OR expires < ?", token, time.Now().Unix())
+	if err != nil {
+		return "", err
+	}
+	if time.Now().Unix() > expires {
+		return "", fmt.Errorf("Connection token expired")
+	}
+	return username, nil
+}
+
+func connectGeminiIdentity(username string, fingerprint string) error {
+	_, err := DB.Exec("INSERT OR REPLACE INTO gemini_identity (fingerprint, username) VALUES (?, ?)", fingerprint, username)
+	return err
+}
+
+// The user's timeline of posts from the feeds they follow
+func timelineHandler(w http.ResponseWriter, r *http.Request) {
+	user := getAuthUser(r)
+	if !user.LoggedIn {
+		renderDefaultError(w, http.StatusForbidden)
+		return
+	}
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	entries, hasMore, err := getTimeline(user.Username, page)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	var nextPage int
+	if hasMore {
+		nextPage = page + 1
+	}
+	data := struct {
+		Config   Config
+		AuthUser AuthUser
+		Entries  []FeedEntry
+		PrevPage int
+		NextPage int
+	}{c, user, entries, page - 1, nextPage}
+	err = t.ExecuteTemplate(w, "timeline.html", data)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+}
+
+// Follow and unfollow feeds, and connect a Gemini client certificate
+func subscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := getAuthUser(r)
+	if !user.LoggedIn {
+		renderDefaultError(w, http.StatusForbidden)
+		return
+	}
+	var errors []string
+	var connectURL string
+	if r.Method == "POST" {
+		r.ParseForm()
+		var err error
+		switch r.URL.Path {
+		case "/subscriptions/add":
+			err = addSubscription(user.Username, r.Form.Get("url"))
+		case "/subscriptions/delete":
+			id, _ := strconv.ParseInt(r.Form.Get("id"), 10, 64)
+			err = deleteSubscription(user.Username, id)
+		case "/subscriptions/connect-gemini":
+			// A single use login token, taken to the Gemini server
+			var token string
+			token, err = createGeminiConnectToken(user.Username)
+			connectURL = "gemini://" + strings.SplitN(c.Host, ":", 2)[0] + "/timeline/connect?" + token
+		case "/subscriptions/disconnect-gemini":
+			_, err = DB.Exec("DELETE FROM gemini_identity WHERE username = ?", user.Username)
+		}
+		if err != nil {
+			log.Println(err)
+			errors = append(errors, err.Error())
+		} else if connectURL == "" {
+			http.Redirect(w, r, "/subscriptions", http.StatusSeeOther)
+			return
+		}
+	}
+	subs, err := getSubscriptions(user.Username)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	var identities int
+	err = DB.QueryRow("SELECT count(*) FROM gemini_identity WHERE username = ?", user.Username).Scan(&identities)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	data := struct {
+		Config           Config
+		AuthUser         AuthUser
+		Subscriptions    []Subscription
+		GeminiIdentities int
+		ConnectURL       string
+		URL              string
+		Errors           []string
+	}{c, user, subs, identities, connectURL, r.URL.Query().Get("url"), errors}
+	err = t.ExecuteTemplate(w, "subscriptions.html", data)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+}
+
+// The timeline over Gemini, for users who have connected their client
+// certificate. /timeline/connect?<token> connects one.
+func gmiTimeline(w gmi.ResponseWriter, r *gmi.Request) {
+	logGemini(r)
+	if r.Certificate == nil {
+		w.Status(gmi.StatusCertificateRequired)
+		return
+	}
+	fingerprint := certFingerprint(r.Certificate.Leaf.Raw)
+	if r.URL.Path == "/timeline/connect" {
+		username, err := consumeGeminiConnectToken(r.URL.RawQuery)
+		if err != nil {
+			w.Status(gmi.StatusCertificateNotAuthorized)
+			w.Meta(err.Error())
+			return
+		}
+		err = connectGeminiIdentity(username, fingerprint)
+		if err != nil {
+			log.Println(err)
+			w.Status(gmi.StatusTemporaryFailure)
+			return
+		}
+		w.Status(gmi.StatusRedirect)
+		w.Meta("/timeline")
+		return
+	} else if r.URL.Path != "/timeline" {
+		w.Status(gmi.StatusNotFound)
+		return
+	}
+	username, err := getGeminiIdentityUser(fingerprint)
+	if err != nil {
+		log.Println(err)
+		w.Status(gmi.StatusTemporaryFailure)
+		return
+	}
+	if username == "" {
+		w.Status(gmi.StatusCertificateNotAuthorized)
+		w.Meta("Connect this certificate to your account at https://" + c.Host + "/subscriptions")
+		return
+	}
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	entries, hasMore, err := getTimeline(username, page)
+	if err != nil {
+		log.Println(err)
+		w.Status(gmi.StatusTemporaryFailure)
+		return
+	}
+	var nextPage int
+	if hasMore {
+		nextPage = page + 1
+	}
+	data := struct {
+		Username string
+		Entries  []FeedEntry
+		PrevPage int
+		NextPage int
+	}{username, entries, page - 1, nextPage}
+	w.Meta("text/gemini")
+	err = gt.ExecuteTemplate(w, "timeline.gmi", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSubscribeToLocalFeed(t *testing.T) {
+	defer setupStorageTest(t)()
+	c.MaxSubscriptionsPerUser = 1
+	addTestUser(t, "alex", true)
+	writeUserFile("alex", "gemlog/2021-01-02-a.gmi", strings.NewReader("# A"))
+	err := addSubscription("bob", "alex.flounder.online/gemlog/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = addSubscription("bob", "gemini://example.com/"); err == nil {
+		t.Error("Subscriptions should be limited")
+	}
+	// New feeds are fetched by the worker, not while subscribing
+	if subs, _ := getSubscriptions("bob"); len(subs) != 1 || subs[0].FetchedAt != 0 {
+		t.Fatalf("Got subscriptions %+v", subs)
+	}
+	select {
+	case <-newSubscription:
+	default:
+		t.Error("Worker wasn't woken up")
+	}
+	refreshSubscriptions()
+	subs, _ := getSubscriptions("bob")
+	if len(subs) != 1 || subs[0].Title != "Alex's Gemlog" || subs[0].Error != "" {
+		t.Fatalf("Got subscriptions %+v", subs)
+	}
+	writeUserFile("alex", "gemlog/2021-02-03-b.gmi", strings.NewReader("# B"))
+	DB.Exec("UPDATE subscription SET fetched_at = 0")
+	refreshSubscriptions()
+	entries, _, err := getTimeline("bob", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Title != "B" || entries[0].Feed.Title != "Alex's Gemlog" {
+		t.Errorf("Got timeline %+v", entries)
+	}
+	deleteSubscription("bob", subs[0].ID)
+	if entries, _, _ := getTimeline("bob", 1); len(entries) != 0 {
+		t.Errorf("Unfollowed feed's entries are still shown")
+	}
+}
+
+func TestFeedEntryWebURL(t *testing.T) {
+	oldConfig := c
+	defer func() { c = oldConfig }()
+	c.Host = "flounder.online"
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"gemini://alex.flounder.online/gemlog/a.gmi", "//alex.flounder.online/gemlog/a.gmi"},
+		{"gemini://flounder.online/", "//flounder.online/"},
+		{"gemini://evilflounder.online/a.gmi", "//proxy.flounder.online/evilflounder.online/a.gmi"},
+		{"gemini://example.com/a.gmi", "//proxy.flounder.online/example.com/a.gmi"},
+		{"https://example.com/a.html", "https://example.com/a.html"},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		if got := (FeedEntry{Url: u}).WebURL(); got != tt.want {
+			t.Errorf("WebURL(%s) = %s, want %s", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestGeminiConnectToken(t *testing.T) {
+	defer setupStorageTest(t)()
+	token, err := createGeminiConnectToken("alex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := consumeProxyLoginToken(token); err == nil {
+		t.Errorf("Connection token logged in to the proxy")
+	}
+	if username, err := consumeGeminiConnectToken(token); username != "alex" || err != nil {
+		t.Errorf("Got %q, %v", username, err)
+	}
+	if _, err := consumeGeminiConnectToken(token); err == nil {
+		t.Errorf("Token was used twice")
+	}
+	token, _ = createProxyLoginToken("alex")
+	if _, err := consumeGeminiConnectToken(token); err == nil {
+		t.Errorf("Proxy login token connected a certificate")
+	}
+}
+
+func TestParseXMLFeed(t *testing.T) {
+	base, _ := url.Parse("https://example.com/feed.xml")
+	for name, tc := range map[string]struct {
+		body  string
+		title string
+		links []string
+		ids   []string
+	}{
+		"atom": {`<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom"><title>Atom</title>
+<entry><title>Old</title><id>urn:1</id><link href="/old" rel="alternate"/><updated>2021-01-02T00:00:00Z</updated></entry>
+<entry><title>New</title><id>urn:2</id><link href="https://example.com/new"/><published>2021-03-04T00:00:00Z</published></entry>
+</feed>`, "Atom", []string{"https://example.com/new", "https://example.com/old"}, []string{"urn:2", "urn:1"}},
+		"rss": {`<?xml version="1.0" encoding="ISO-8859-1"?>
+<rss version="2.0"><channel><title>RSS</title>
+<item><title>Post</title><link>https://example.com/post</link><guid>abc</guid><pubDate>Tue, 02 Feb 2021 10:00:00 +0000</pubDate></item>
+</channel></rss>`, "RSS", []string{"https://example.com/post"}, []string{"abc"}},
+		"rss 1.0": {`<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#" xmlns="http://purl.org/rss/1.0/">
+<channel><title>RDF</title></channel>
+<item><title>Post</title><link>https://example.com/rdf</link></item>
+</rdf:RDF>`, "RDF", []string{"https://example.com/rdf"}, []string{""}},
+	} {
+		feed, err := parseXMLFeed([]byte(tc.body), base)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		var links, ids []string
+		for _, e := range feed.Entries {
+			links = append(links, e.Url.String())
+			ids = append(ids, e.Guid)
+		}
+		if feed.Title != tc.title || !reflect.DeepEqual(links, tc.links) || !reflect.DeepEqual(ids, tc.ids) {
+			t.Errorf("%s: got %q %v %v", name, feed.Title, links, ids)
+		}
+	}
+	if _, err := parseXMLFeed([]byte("<html><body>hi</body></html>"), base); err == nil {
+		t.Error("HTML pages aren't feeds")
+	}
+}
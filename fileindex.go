@@ -0,0 +1,329 @@
+// Index of when each user file was last updated, for the "recently updated"
+// lists on the home pages, and of the text of public pages for search. The
+// storage helpers keep it current, and it's rebuilt from the files along
+// with the usage counts.
+package main
+
+import (
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+const indexPageSize = 50
+
+func inHiddenFolder(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if part == HiddenFolder {
+			return true
+		}
+	}
+	return false
+}
+
+// Text files outside hidden folders are searchable
+func isSearchable(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	return !inHiddenFolder(name) && (ext == ".gmi" || ext == ".gemini" || ext == ".txt")
+}
+
+// The first heading of a gemtext file, or the file name
+func searchTitle(name string, content []byte) string {
+	if isGemini(name) {
+		for _, line := range strings.Split(string(content), "\n") {
+			if strings.HasPrefix(line, "#") {
+				return strings.TrimSpace(strings.TrimLeft(line, "#"))
+			}
+		}
+	}
+	return name
+}
+
+// Record an update to a file. The content is only used if the file is
+// searchable. Unpublished files aren't searchable and don't mention anyone.
+func indexFile(username string, name string, updated time.Time, content []byte) error {
+	name = cleanStorageName(name)
+	_, err := DB.Exec(`INSERT INTO file_index (username, name, updated_at) VALUES (?, ?, ?)
+ON CONFLICT(username, name) DO UPDATE SET updated_at = excluded.updated_at`,
+		username, name, updated.Unix())
+	if err != nil {
+		return err
+	}
+	published := isPublished(username, name)
+	_, err = DB.Exec("DELETE FROM search_index WHERE username = ? AND name = ?", username, name)
+	if err == nil && published && isSearchable(name) {
+		_, err = DB.Exec("INSERT INTO search_index (username, name, updated_at, title, content) VALUES (?, ?, ?, ?, ?)",
+			username, name, updated.Unix(), searchTitle(name, content), string(content))
+	}
+	if err == nil && isGemini(name) {
+		if published {
+			err = updateMentions(username, name, content)
+		} else {
+			err = deleteMentions(username, name)
+		}
+	}
+	if err == nil && inGemlog(name) {
+		err = refreshPlanetEntries(username)
+	}
+	if err == nil && name == siteConfigFile {
+		err = loadSiteConfig(username)
+	}
+	return err
+}
+
+// Remove a file, or a folder and everything in it, from the index
+func unindexFile(username string, name string) error {
+	name = cleanStorageName(name)
+	for _, table := range []string{"file_index", "search_index", "file_state", "file_published"} {
+		_, err := DB.Exec(`DELETE FROM `+table+` WHERE username = ? AND (name = ? OR substr(name, 1, ?) = ?)`,
+			username, name, len(name)+1, name+"/")
+		if err != nil {
+			return err
+		}
+	}
+	err := deleteMentions(username, name)
+	if err != nil {
+		return err
+	}
+	if name == siteConfigFile {
+		err = loadSiteConfig(username)
+		if err != nil {
+			return err
+		}
+	}
+	if inGemlog(name) {
+		return refreshPlanetEntries(username)
+	}
+	return nil
+}
+
+func renameIndexedFile(username string, oldName string, newName string) error {
+	oldName, newName = cleanStorageName(oldName), cleanStorageName(newName)
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	// Whatever was replaced goes first, or the moved rows would clash with it
+	for _, table := range []string{"file_index", "search_index", "file_state", "file_published"} {
+		_, err = tx.Exec(`DELETE FROM `+table+` WHERE username = ? AND (name = ? OR substr(name, 1, ?) = ?)`,
+			username, newName, len(newName)+1, newName+"/")
+		if err == nil {
+			_, err = tx.Exec(`UPDATE `+table+` SET name = ? || substr(name, ?) WHERE username = ? AND (name = ? OR substr(name, 1, ?) = ?)`,
+				newName, len(oldName)+1, username, oldName, len(oldName)+1, oldName+"/")
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err = tx.Exec(`DELETE FROM mention WHERE source_username = ? AND (source_name = ? OR substr(source_name, 1, ?) = ?)`,
+		username, newName, len(newName)+1, newName+"/")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	err = renameMentions(username, oldName, newName)
+	if err != nil {
+		return err
+	}
+	if oldName == siteConfigFile || newName == siteConfigFile {
+		err = loadSiteConfig(username)
+		if err != nil {
+			return err
+		}
+	}
+	// Files may have moved in or out of a hidden folder, or changed type
+	if inHiddenFolder(oldName) != inHiddenFolder(newName) || isSearchable(oldName) != isSearchable(newName) {
+		return reindexUserFiles(username)
+	}
+	if inGemlog(oldName) || inGemlog(newName) {
+		return refreshPlanetEntries(username)
+	}
+	return nil
+}
+
+// Replace a user's entries with what's actually in their folder. Only
+// files that changed since they were indexed are read. Files count as
+// updated when they were last published, if that's later.
+func reindexUserFiles(username string) error {
+	type entry struct {
+		name    string
+		updated int64
+		title   string
+		content string
+	}
+	indexed := map[string]int64{}
+	rows, err := DB.Query("SELECT name, updated_at FROM search_index WHERE username = ?", username)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var name string
+		var updated int64
+		err = rows.Scan(&name, &updated)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		indexed[name] = updated
+	}
+	rows.Close()
+	published, err := getPublishTimes(username)
+	if err != nil {
+		return err
+	}
+
+	var entries, changed []entry
+	userFolder := getUserDirectory(username)
+	err = store.Walk(userFolder, func(thepath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		e := entry{name: getLocalPath(thepath), updated: info.ModTime().Unix()}
+		if published[e.name] > e.updated {
+			e.updated = published[e.name]
+		}
+		entries = append(entries, e)
+		if updated, ok := indexed[e.name]; isSearchable(e.name) && (!ok || updated != e.updated) {
+			content, err := readStorageFile(thepath)
+			if err != nil {
+				return err
+			}
+			e.title, e.content = searchTitle(e.name, content), string(content)
+			changed = append(changed, e)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM file_index WHERE username = ?", username)
+	for _, e := range entries {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec("INSERT INTO file_index (username, name, updated_at) VALUES (?, ?, ?)", username, e.name, e.updated)
+		if err == nil && !isSearchable(e.name) {
+			_, err = tx.Exec("DELETE FROM search_index WHERE username = ? AND name = ?", username, e.name)
+		}
+	}
+	for _, e := range changed {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec("DELETE FROM search_index WHERE username = ? AND name = ?", username, e.name)
+		if err == nil {
+			_, err = tx.Exec("INSERT INTO search_index (username, name, updated_at, title, content) VALUES (?, ?, ?, ?, ?)",
+				username, e.name, e.updated, e.title, e.content)
+		}
+	}
+	if err == nil {
+		// Files that are gone
+		_, err = tx.Exec(`DELETE FROM search_index WHERE username = ?
+  AND name NOT IN (SELECT name FROM file_index WHERE username = ?)`, username, username)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	// Unpublished files aren't searchable
+	_, err = DB.Exec(`DELETE FROM search_index WHERE username = ?
+  AND name IN (SELECT name FROM file_state WHERE username = ?)`, username, username)
+	if err != nil {
+		return err
+	}
+	for _, e := range changed {
+		if isGemini(e.name) && isPublished(username, e.name) {
+			err = updateMentions(username, e.name, []byte(e.content))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// Links from files that are gone or hidden now
+	_, err = DB.Exec(`DELETE FROM mention WHERE source_username = ?
+  AND source_name NOT IN (SELECT name FROM search_index WHERE username = ?)`, username, username)
+	if err != nil {
+		return err
+	}
+	err = loadSiteConfig(username)
+	if err != nil {
+		return err
+	}
+	return refreshPlanetEntries(username)
+}
+
+// Recently updated files of listed users, newest first, a page at a time.
+// Pages start at 1. Files in hidden folders are only shown to admins, and
+// unpublished files to no one.
+func getIndexFiles(admin bool, page int) ([]*File, bool, error) {
+	if page < 1 {
+		page = 1
+	}
+	rows, err := DB.Query(`SELECT file_index.username, name, updated_at FROM file_index
+  JOIN user ON user.username = file_index.username
+  LEFT JOIN site_config ON site_config.username = file_index.username
+  WHERE coalesce(site_config.listed, user.listed) AND (? OR '/' || name NOT LIKE ?)
+  AND NOT EXISTS (SELECT 1 FROM file_state WHERE file_state.username = file_index.username AND file_state.name = file_index.name)
+  ORDER BY updated_at DESC LIMIT ? OFFSET ?`,
+		admin, "%/"+HiddenFolder+"/%", indexPageSize+1, (page-1)*indexPageSize)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	result := []*File{}
+	for rows.Next() {
+		var f File
+		var updated int64
+		err = rows.Scan(&f.Creator, &f.Name, &updated)
+		if err != nil {
+			return nil, false, err
+		}
+		f.UpdatedTime = time.Unix(updated, 0)
+		f.TimeAgo = timeago(&f.UpdatedTime)
+		f.Host = c.Host
+		result = append(result, &f)
+	}
+	hasMore := len(result) > indexPageSize
+	if hasMore {
+		result = result[:indexPageSize]
+	}
+	return result, hasMore, rows.Err()
+}
+
+// Names of a user's files that visitors can see, for linking to them
+func getLinkableFiles(username string) ([]string, error) {
+	rows, err := DB.Query(`SELECT name FROM file_index WHERE username = ? AND '/' || name NOT LIKE ? ORDER BY name`,
+		username, "%/"+HiddenFolder+"/%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
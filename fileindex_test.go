@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestFileIndex(t *testing.T) {
+	defer setupStorageTest(t)()
+	// For folders
+	c.OkExtensions = append(c.OkExtensions, "")
+	addTestUser(t, "alex", false)
+	names := func(admin bool) []string {
+		t.Helper()
+		files, _, err := getIndexFiles(admin, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result []string
+		for _, f := range files {
+			result = append(result, f.Creator+"/"+f.Name)
+		}
+		sort.Strings(result)
+		return result
+	}
+	writeUserFile("alex", "a.gmi", strings.NewReader("a"))
+	writeUserFile("alex", "folder/b.gmi", strings.NewReader("b"))
+	writeUserFile("alex", HiddenFolder+"/c.gmi", strings.NewReader("c"))
+	if got, want := names(false), []string{"alex/a.gmi", "alex/folder/b.gmi"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+	if got := names(true); len(got) != 3 {
+		t.Errorf("Admins should see hidden files, got %v", got)
+	}
+	renameUserFile("alex", "folder", "other")
+	deleteUserFile("alex", "a.gmi")
+	if got, want := names(false), []string{"alex/other/b.gmi"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+	DB.Exec("UPDATE user SET listed = false WHERE username = 'alex'")
+	if got := names(false); len(got) != 0 {
+		t.Errorf("Unlisted user's files are shown: %v", got)
+	}
+	DB.Exec("UPDATE user SET listed = true WHERE username = 'alex'")
+
+	// Renaming onto a file replaces its entries
+	writeUserFile("alex", "c.gmi", strings.NewReader("# C\nalpha"))
+	writeUserFile("alex", "d.gmi", strings.NewReader("# D\nbeta"))
+	if err := renameUserFile("alex", "c.gmi", "d.gmi"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := names(false), []string{"alex/d.gmi", "alex/other/b.gmi"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+	var content string
+	DB.QueryRow("SELECT group_concat(content) FROM search_index WHERE name IN ('c.gmi', 'd.gmi')").Scan(&content)
+	if content != "# C\nalpha" {
+		t.Errorf("Search should have the renamed file only, got %q", content)
+	}
+	deleteUserFile("alex", "d.gmi")
+
+	for i := 0; i < indexPageSize; i++ {
+		store.Write(userFilePath("alex", fmt.Sprintf("%d.gmi", i)), strings.NewReader("x"))
+	}
+	if err := reindexUserFiles("alex"); err != nil {
+		t.Fatal(err)
+	}
+	files, hasMore, _ := getIndexFiles(false, 1)
+	if len(files) != indexPageSize || !hasMore {
+		t.Errorf("First page has %d files, more: %v", len(files), hasMore)
+	}
+	files, hasMore, _ = getIndexFiles(false, 2)
+	if len(files) != 1 || hasMore {
+		t.Errorf("Second page has %d files, more: %v", len(files), hasMore)
+	}
+}
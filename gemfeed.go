@@ -4,8 +4,10 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	gmi "git.sr.ht/~adnano/go-gemini"
 	"github.com/gorilla/feeds"
-	"io/ioutil"
+	"log"
 	"net/url"
 	"os"
 	"path"
@@ -16,29 +18,13 @@ import (
 )
 
 type Gemfeed struct {
-	Title   string
-	Creator string
-	Url     *url.URL
-	Entries []FeedEntry
-}
-
-func (gf *Gemfeed) toAtomFeed() string {
-	feed := feeds.Feed{
-		Title:  gf.Title,
-		Author: &feeds.Author{Name: gf.Creator},
-		Link:   &feeds.Link{Href: gf.Url.String()},
-	}
-	feed.Items = []*feeds.Item{}
-	for _, fe := range gf.Entries {
-		feed.Items = append(feed.Items, &feeds.Item{
-			Title:   fe.Title,
-			Link:    &feeds.Link{Href: fe.Url.String()}, // Rel=alternate?
-			Created: fe.Date,                            // Updated not created?
-			Content: fe.Content,
-		})
-	}
-	res, _ := feed.ToAtom()
-	return res
+	Title    string
+	Subtitle string
+	Creator  string
+	Rights   string // license of the entries
+	Url      *url.URL
+	Updated  time.Time // of the latest entry
+	Entries  []FeedEntry
 }
 
 type FeedEntry struct {
@@ -46,11 +32,199 @@ type FeedEntry struct {
 	Url        *url.URL
 	Date       time.Time
 	DateString string
+	Updated    time.Time // modification time if the entry is a local file
+	Guid       string    // id from an Atom or RSS feed
 	Feed       *Gemfeed
 	File       string // TODO refactor
 	Content    string
 }
 
+// Content types for the ?format= values and feed files
+var feedContentTypes = map[string]string{
+	"atom": "application/atom+xml",
+	"rss":  "application/rss+xml",
+	"json": "application/feed+json",
+}
+
+// The id from the source feed, or a tag URI (RFC 4151), which stays the same
+// when the post is edited or the feed is fetched over another protocol
+func (fe *FeedEntry) Id() string {
+	if fe.Guid != "" {
+		return fe.Guid
+	}
+	host := strings.Split(fe.Url.Host, ":")[0]
+	return "tag:" + host + "," + fe.DateString + ":/" + strings.TrimPrefix(fe.Url.EscapedPath(), "/")
+}
+
+// Parse a gemtext page as a feed. The first level 1 heading is the title,
+// and a level 2 heading right after it the subtitle. Each link whose label
+// starts with a yyyy-mm-dd date is an entry. Links are resolved against
+// base.
+func parseGemfeed(text gmi.Text, base *url.URL) *Gemfeed {
+	feed := Gemfeed{Url: base}
+	for i, line := range text {
+		switch l := line.(type) {
+		case gmi.LineHeading1:
+			if feed.Title != "" {
+				continue
+			}
+			feed.Title = strings.TrimSpace(string(l))
+			if i+1 < len(text) {
+				if sub, ok := text[i+1].(gmi.LineHeading2); ok {
+					feed.Subtitle = strings.TrimSpace(string(sub))
+				}
+			}
+		case gmi.LineLink:
+			if len(l.Name) < 10 {
+				continue
+			}
+			date, err := time.Parse("2006-01-02", l.Name[:10])
+			if err != nil {
+				continue
+			}
+			u, err := url.Parse(l.URL)
+			if err != nil {
+				continue
+			}
+			if base != nil {
+				u = base.ResolveReference(u)
+			}
+			entry := FeedEntry{
+				Title:      strings.TrimSpace(strings.TrimLeft(l.Name[10:], " \t-:")),
+				Url:        u,
+				Date:       date,
+				DateString: l.Name[:10],
+				Updated:    date,
+				Feed:       &feed,
+			}
+			if entry.Title == "" {
+				entry.Title = entry.DateString
+			}
+			feed.Entries = append(feed.Entries, entry)
+		}
+	}
+	sortFeed(&feed)
+	return &feed
+}
+
+// Reverse chronological sort, and set the feed's updated time
+func sortFeed(feed *Gemfeed) {
+	sort.SliceStable(feed.Entries, func(i, j int) bool {
+		return feed.Entries[i].Date.After(feed.Entries[j].Date)
+	})
+	for _, entry := range feed.Entries {
+		if entry.Updated.After(feed.Updated) {
+			feed.Updated = entry.Updated
+		}
+	}
+}
+
+// Fill in the content and modification time of entries that are the user's
+// own gemtext files. Entries for files that aren't published are dropped.
+func loadLocalEntries(feed *Gemfeed, user string) {
+	states, err := getFileStates(user)
+	if err != nil {
+		log.Println(err)
+	}
+	entries := feed.Entries[:0]
+	for _, entry := range feed.Entries {
+		if entry.Url.Host != feed.Url.Host || (entry.Url.Scheme != "" && entry.Url.Scheme != "gemini") {
+			entries = append(entries, entry)
+			continue
+		}
+		fullPath := path.Join(getUserDirectory(user), path.Clean("/"+entry.Url.Path))
+		if inHiddenFolder(getLocalPath(fullPath)) {
+			entries = append(entries, entry)
+			continue
+		}
+		info, err := store.Stat(fullPath)
+		if err == nil && info.IsDir() {
+			fullPath = path.Join(fullPath, "index.gmi")
+			info, err = store.Stat(fullPath)
+		}
+		if err != nil {
+			entries = append(entries, entry)
+			continue
+		}
+		if states[getLocalPath(fullPath)] != nil {
+			continue
+		}
+		entry.Updated = info.ModTime()
+		entry.File = getLocalPath(fullPath)
+		if isGemini(fullPath) {
+			content, err := readStorageFile(fullPath)
+			if err == nil {
+				entry.Content = string(content)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	feed.Entries = entries
+	feed.Updated = time.Time{}
+	sortFeed(feed)
+}
+
+// The feed as a gorilla feed, with entry content rendered to HTML. Links to
+// this instance use scheme.
+func (gf *Gemfeed) toFeed(scheme string) *feeds.Feed {
+	withScheme := func(u *url.URL) string {
+		v := *u
+		if v.Scheme == "" || (v.Scheme == "gemini" && strings.HasSuffix(v.Host, c.Host)) {
+			v.Scheme = scheme
+		}
+		return v.String()
+	}
+	feed := feeds.Feed{
+		Title:       gf.Title,
+		Description: gf.Subtitle,
+		Subtitle:    gf.Subtitle,
+		Link:        &feeds.Link{Href: withScheme(gf.Url)},
+		Updated:     gf.Updated,
+	}
+	if gf.Creator != "" {
+		feed.Author = &feeds.Author{Name: gf.Creator}
+	}
+	feed.Copyright = gf.Rights
+	renderer := newHTMLRenderer(nil)
+	renderer.Scheme = scheme
+	feed.Items = []*feeds.Item{}
+	for _, fe := range gf.Entries {
+		item := &feeds.Item{
+			Title:   fe.Title,
+			Link:    &feeds.Link{Href: withScheme(fe.Url)},
+			Id:      fe.Id(),
+			Created: fe.Date,
+			Updated: fe.Updated,
+		}
+		// Entries from other feeds, as on the planet
+		if fe.Feed != nil && fe.Feed.Creator != gf.Creator {
+			item.Author = &feeds.Author{Name: fe.Feed.Creator}
+		}
+		if fe.Content != "" {
+			parse, err := gmi.ParseText(strings.NewReader(fe.Content))
+			if err == nil {
+				// Resolve relative links against the post
+				renderer.BaseURL = &url.URL{Scheme: "gemini", Host: fe.Url.Host, Path: fe.Url.Path}
+				item.Content = renderer.Render(parse).Content
+			}
+		}
+		feed.Items = append(feed.Items, item)
+	}
+	return &feed
+}
+
+// Render the feed as "atom", "rss" or "json"
+func (gf *Gemfeed) render(format string, scheme string) (string, error) {
+	feed := gf.toFeed(scheme)
+	switch format {
+	case "rss":
+		return feed.ToRss()
+	case "json":
+		return feed.ToJSON()
+	}
+	return feed.ToAtom()
+}
+
 func urlFromPath(fullPath string) url.URL {
 	creator := getCreator(fullPath)
 	baseUrl := url.URL{}
@@ -59,18 +233,73 @@ func urlFromPath(fullPath string) url.URL {
 	return baseUrl
 }
 
-// Non-standard extension
-// Requires yyyy-mm-dd formatted files
+// The feed for a user's page, with local entries filled in
+func generateFeedFromPage(user string, fullPath string, text gmi.Text) *Gemfeed {
+	u := urlFromPath(fullPath)
+	feed := parseGemfeed(text, &u)
+	getSiteConfig(user).applyToFeed(feed, user)
+	if feed.Title == "" {
+		folder := getLocalPath(fullPath)
+		if isGemini(folder) {
+			folder = path.Dir(folder)
+		}
+		feed.Title = defaultFeedTitle(user, folder)
+	}
+	loadLocalEntries(feed, user)
+	return feed
+}
+
+// The user's gemlog
 func generateFeedFromUser(user string) *Gemfeed {
-	gemlogFolderPath := path.Join(c.FilesDirectory, user, GemlogFolder)
+	folder, err := getFeedFolder(user, GemlogFolder)
+	if err != nil || folder == nil {
+		folder = &FeedFolder{Folder: GemlogFolder}
+	}
+	return generateFeedFromFolder(user, folder)
+}
+
+// A feed folder: its index.gmi parsed as a feed if it has any entries,
+// otherwise the yyyy-mm-dd formatted files in the folder.
+func generateFeedFromFolder(user string, folder *FeedFolder) *Gemfeed {
+	site := getSiteConfig(user)
+	settings := *folder
+	site.fillFeedFolder(&settings)
+	folder = &settings
+	folderPath := path.Join(getUserDirectory(user), folder.Folder)
 	// NOTE: assumes sanitized input
-	u := urlFromPath(gemlogFolderPath)
+	u := urlFromPath(folderPath)
+	indexPath := path.Join(folderPath, "index.gmi")
+	if content, err := readStorageFile(indexPath); err == nil {
+		text, err := gmi.ParseText(bytes.NewReader(content))
+		if err == nil {
+			feed := generateFeedFromPage(user, indexPath, text)
+			if len(feed.Entries) > 0 {
+				feed.Url = &u
+				folder.apply(feed)
+				return feed
+			}
+		}
+	}
 	feed := Gemfeed{
-		Title:   strings.Title(user) + "'s Gemlog",
-		Creator: user,
-		Url:     &u,
+		Title: defaultFeedTitle(user, folder.Folder),
+		Url:   &u,
 	}
-	err := filepath.Walk(gemlogFolderPath, func(thepath string, info os.FileInfo, err error) error {
+	site.applyToFeed(&feed, user)
+	states, err := getFileStates(user)
+	if err != nil {
+		log.Println(err)
+	}
+	err = store.Walk(folderPath, func(thepath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		name := getLocalPath(thepath)
+		if info.IsDir() && inHiddenFolder(name) {
+			return filepath.SkipDir
+		}
+		if info.IsDir() || states[name] != nil {
+			return nil
+		}
 		base := path.Base(thepath)
 		if len(base) >= 10 {
 			entry := FeedEntry{}
@@ -80,13 +309,13 @@ func generateFeedFromUser(user string) *Gemfeed {
 			}
 			entry.Date = date
 			entry.DateString = base[:10]
+			entry.Updated = info.ModTime()
 			entry.Feed = &feed
-			f, err := os.Open(thepath)
+			content, err := readStorageFile(thepath)
 			if err != nil {
 				return nil
 			}
-			defer f.Close()
-			scanner := bufio.NewScanner(f)
+			scanner := bufio.NewScanner(bytes.NewReader(content))
 			for scanner.Scan() {
 				// skip blank lines
 				if scanner.Text() == "" {
@@ -106,10 +335,6 @@ func generateFeedFromUser(user string) *Gemfeed {
 				}
 				break
 			}
-			content, err := ioutil.ReadFile(thepath)
-			if err != nil {
-				return nil
-			}
 			entry.Content = string(content)
 			entry.File = getLocalPath(thepath)
 			u := urlFromPath(thepath)
@@ -121,9 +346,7 @@ func generateFeedFromUser(user string) *Gemfeed {
 	if err != nil {
 		return nil
 	}
-	// Reverse chronological sort
-	sort.Slice(feed.Entries, func(i, j int) bool {
-		return feed.Entries[i].Date.After(feed.Entries[j].Date)
-	})
+	sortFeed(&feed)
+	folder.apply(&feed)
 	return &feed
 }
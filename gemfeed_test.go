@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	gmi "git.sr.ht/~adnano/go-gemini"
+)
+
+func TestParseGemfeed(t *testing.T) {
+	page := `# My Gemlog
+## Thoughts and such
+
+=> about.gmi About me
+=> 2021-01-02-old.gmi 2021-01-02 - Older post
+=> gemini://example.com/post.gmi 2021-03-04 Elsewhere
+=> /gemlog/new.gmi 2021-02-03: Newer post
+`
+	text, err := gmi.ParseText(strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := &url.URL{Host: "alex.flounder.online", Path: "/gemlog/index.gmi"}
+	feed := parseGemfeed(text, base)
+	if feed.Title != "My Gemlog" || feed.Subtitle != "Thoughts and such" {
+		t.Errorf("Got title %q and subtitle %q", feed.Title, feed.Subtitle)
+	}
+	want := []struct{ title, url, id string }{
+		{"Elsewhere", "gemini://example.com/post.gmi", "tag:example.com,2021-03-04:/post.gmi"},
+		{"Newer post", "//alex.flounder.online/gemlog/new.gmi", "tag:alex.flounder.online,2021-02-03:/gemlog/new.gmi"},
+		{"Older post", "//alex.flounder.online/gemlog/2021-01-02-old.gmi", "tag:alex.flounder.online,2021-01-02:/gemlog/2021-01-02-old.gmi"},
+	}
+	if len(feed.Entries) != len(want) {
+		t.Fatalf("Got %d entries, want %d", len(feed.Entries), len(want))
+	}
+	for i, w := range want {
+		e := feed.Entries[i]
+		if e.Title != w.title || e.Url.String() != w.url || e.Id() != w.id {
+			t.Errorf("Entry %d is %q %s %s, want %q %s %s", i, e.Title, e.Url, e.Id(), w.title, w.url, w.id)
+		}
+	}
+	if !feed.Updated.Equal(feed.Entries[0].Date) {
+		t.Errorf("Feed updated %v, want %v", feed.Updated, feed.Entries[0].Date)
+	}
+}
@@ -7,11 +7,11 @@ import (
 	gmi "git.sr.ht/~adnano/go-gemini"
 	"git.sr.ht/~adnano/go-gemini/certificate"
 	"io"
-	"io/ioutil"
 	"log"
-	"os"
+	"net/url"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"text/template"
 	"time"
@@ -19,24 +19,33 @@ import (
 
 var gt *template.Template
 
-func generateGemfeedPage(user string) string {
-	feed := generateFeedFromUser(user)
+func generateGemfeedPage(user string, folder *FeedFolder) string {
+	feed := generateFeedFromFolder(user, folder)
 	data := struct {
 		Host        string
+		Folder      string
 		Title       string
+		Subtitle    string
 		FeedEntries []FeedEntry
-	}{c.Host, feed.Title, feed.Entries}
+	}{c.Host, folder.Folder, feed.Title, feed.Subtitle, feed.Entries}
 	var buff bytes.Buffer
 	gt.ExecuteTemplate(&buff, "gemfeed.gmi", data)
 	return buff.String()
 }
 
 func generateFolderPage(fullpath string) string {
-	files, _ := ioutil.ReadDir(fullpath)
+	files, _ := store.ReadDir(fullpath)
+	states, err := getFileStates(getCreator(fullpath))
+	if err != nil {
+		log.Println(err)
+	}
 	var renderedFiles = []File{}
 	for _, file := range files {
 		// Very awkward
 		res := fileFromPath(path.Join(fullpath, file.Name()))
+		if states[res.Name] != nil {
+			continue
+		}
 		renderedFiles = append(renderedFiles, res)
 	}
 	var buff bytes.Buffer
@@ -45,7 +54,7 @@ func generateFolderPage(fullpath string) string {
 		Folder string
 		Files  []File
 	}{c.Host, getLocalPath(fullpath), renderedFiles}
-	err := gt.ExecuteTemplate(&buff, "folder.gmi", data)
+	err = gt.ExecuteTemplate(&buff, "folder.gmi", data)
 	if err != nil {
 		log.Println(err)
 		return ""
@@ -59,26 +68,134 @@ func gmiIndex(w gmi.ResponseWriter, r *gmi.Request) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	files, err := getIndexFiles(false)
-	users, err := getActiveUserNames()
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	files, hasMore, err := getIndexFiles(false, page)
 	if err != nil {
 		log.Println(err)
 		w.Status(gmi.StatusTemporaryFailure)
+		return
+	}
+	users, err := getListedUserNames()
+	if err != nil {
+		log.Println(err)
+		w.Status(gmi.StatusTemporaryFailure)
+		return
+	}
+	siteTitles, err := getSiteTitles()
+	if err != nil {
+		log.Println(err)
+	}
+	var nextPage int
+	if hasMore {
+		nextPage = page + 1
 	}
 	data := struct {
-		Host      string
-		SiteTitle string
-		Files     []*File
-		Users     []string
+		Host       string
+		SiteTitle  string
+		Files      []*File
+		Users      []string
+		SiteTitles map[string]string
+		PrevPage   int
+		NextPage   int
 	}{
-		Host:      c.Host,
-		SiteTitle: c.SiteTitle,
-		Files:     files,
-		Users:     users,
+		Host:       c.Host,
+		SiteTitle:  c.SiteTitle,
+		Files:      files,
+		Users:      users,
+		SiteTitles: siteTitles,
+		PrevPage:   page - 1,
+		NextPage:   nextPage,
 	}
 	t.Execute(w, data)
 }
 
+// /search asks for a query and searches all listed sites, /search/<user>
+// searches one site.
+func gmiSearch(w gmi.ResponseWriter, r *gmi.Request) {
+	logGemini(r)
+	site := strings.Trim(strings.TrimPrefix(r.URL.Path, "/search"), "/")
+	q, err := url.QueryUnescape(r.URL.RawQuery)
+	if err != nil || q == "" {
+		w.Status(gmi.StatusInput)
+		if site != "" {
+			w.Meta("Search " + site + "." + c.Host)
+		} else {
+			w.Meta("Search " + c.SiteTitle)
+		}
+		return
+	}
+	results, err := searchFiles(q, site)
+	if err != nil {
+		log.Println(err)
+		w.Status(gmi.StatusTemporaryFailure)
+		return
+	}
+	data := struct {
+		Host    string
+		Query   string
+		Site    string
+		Results []SearchResult
+	}{c.Host, q, site, results}
+	w.Meta("text/gemini")
+	err = gt.ExecuteTemplate(w, "search.gmi", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Recent gemlog posts from everyone, with feeds at /planet/atom.xml etc
+func gmiPlanet(w gmi.ResponseWriter, r *gmi.Request) {
+	logGemini(r)
+	if base := strings.TrimPrefix(r.URL.Path, "/planet/"); feedFiles[base] != "" {
+		feed, err := generatePlanetFeed()
+		if err != nil {
+			log.Println(err)
+			w.Status(gmi.StatusTemporaryFailure)
+			return
+		}
+		body, err := feed.render(feedFiles[base], "gemini")
+		if err != nil {
+			log.Println(err)
+			w.Status(gmi.StatusTemporaryFailure)
+			return
+		}
+		w.Meta(feedContentTypes[feedFiles[base]])
+		io.Copy(w, strings.NewReader(body))
+		return
+	} else if r.URL.Path != "/planet" {
+		w.Status(gmi.StatusNotFound)
+		return
+	}
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	entries, hasMore, err := getPlanetEntries(page)
+	if err != nil {
+		log.Println(err)
+		w.Status(gmi.StatusTemporaryFailure)
+		return
+	}
+	var nextPage int
+	if hasMore {
+		nextPage = page + 1
+	}
+	data := struct {
+		SiteTitle string
+		Entries   []FeedEntry
+		PrevPage  int
+		NextPage  int
+	}{c.SiteTitle, entries, page - 1, nextPage}
+	w.Meta("text/gemini")
+	err = gt.ExecuteTemplate(w, "planet.gmi", data)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
 func gmiPage(w gmi.ResponseWriter, r *gmi.Request) {
 	logGemini(r) // TODO move into wrapper
 	var userName string
@@ -95,26 +212,74 @@ func gmiPage(w gmi.ResponseWriter, r *gmi.Request) {
 		w.Status(gmi.StatusNotFound)
 		return
 	}
-	fullPath := path.Join(c.FilesDirectory, userName, fileName)
-	if fileName == "/gemlog" { // temp hack
-		_, err := os.Stat(path.Join(fullPath, "index.gmi"))
-		if err != nil {
-			w.Meta("text/gemini")
-			io.Copy(w, strings.NewReader(generateGemfeedPage(userName)))
+	fullPath := path.Join(getUserDirectory(userName), fileName)
+	meta := "text/gemini"
+	if site := getSiteConfig(userName); site.Language != "" {
+		meta += "; lang=" + site.Language
+	}
+	dir, base := path.Split(fileName)
+	if format, ok := feedFiles[base]; ok {
+		_, err := store.Stat(fullPath)
+		folder, _ := getFeedFolder(userName, dir)
+		if err != nil && folder != nil {
+			feed := generateFeedFromFolder(userName, folder)
+			if feed == nil {
+				w.Status(gmi.StatusNotFound)
+				return
+			}
+			body, err := feed.render(format, "gemini")
+			if err != nil {
+				log.Println(err)
+				w.Status(gmi.StatusTemporaryFailure)
+				return
+			}
+			w.Meta(feedContentTypes[format])
+			io.Copy(w, strings.NewReader(body))
 			return
 		}
-	} else if fileName == "/gemlog/atom.xml" {
-		_, err := os.Stat(fullPath)
-		if err != nil {
-			w.Meta("application/atom+xml")
-			feed := generateFeedFromUser(userName)
-			atomString := feed.toAtomFeed()
-			io.Copy(w, strings.NewReader(atomString))
+	} else if info, err := store.Stat(fullPath); err != nil || info.IsDir() {
+		_, err := store.Stat(path.Join(fullPath, "index.gmi"))
+		folder, _ := getFeedFolder(userName, fileName)
+		if err != nil && folder != nil {
+			w.Meta(meta)
+			io.Copy(w, strings.NewReader(generateGemfeedPage(userName, folder)))
 			return
 		}
 	}
 
-	gmi.ServeFile(w, gmi.Dir(path.Join(c.FilesDirectory, userName)), fileName)
+	name := cleanStorageName(fileName)
+	redirect := false
+	if info, err := store.Stat(fullPath); err == nil && info.IsDir() {
+		name = path.Join(name, "index.gmi")
+		// Folders without a trailing slash are redirected below
+		redirect = !strings.HasSuffix(r.URL.Path, "/")
+	}
+	if !isPublished(userName, name) {
+		w.Status(gmi.StatusNotFound)
+		return
+	}
+	var mentions []Mention
+	if owner, err := getUserByName(userName); err == nil && owner.ShowMentions {
+		mentions, err = getMentions(userName, name)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	// Pages are served here when they need more than the file
+	if !redirect && isGemini(name) && (len(mentions) > 0 || meta != "text/gemini") {
+		if content, err := readStorageFile(path.Join(getUserDirectory(userName), name)); err == nil {
+			if len(mentions) > 0 {
+				if !bytes.HasSuffix(content, []byte("\n")) {
+					content = append(content, '\n')
+				}
+				content = append(content, mentionLines(mentions).String()...)
+			}
+			w.Meta(meta)
+			w.Write(content)
+			return
+		}
+	}
+	gmi.ServeFile(w, storageFS{getUserDirectory(userName)}, fileName)
 }
 
 func runGeminiServer() {
@@ -147,6 +312,12 @@ func runGeminiServer() {
 	var mux gmi.ServeMux
 	// replace with wildcard cert
 	mux.HandleFunc("/", gmiIndex)
+	mux.HandleFunc("/search", gmiSearch)
+	mux.HandleFunc("/search/", gmiSearch)
+	mux.HandleFunc("/planet", gmiPlanet)
+	mux.HandleFunc("/planet/", gmiPlanet)
+	mux.HandleFunc("/timeline", gmiTimeline)
+	mux.HandleFunc("/timeline/", gmiTimeline)
 
 	var wildcardMux gmi.ServeMux
 	wildcardMux.HandleFunc("/", gmiPage)
@@ -3,8 +3,11 @@ package main
 import (
 	"fmt"
 	"html"
+	"io"
 	"net/url"
+	"path"
 	"strings"
+	"unicode"
 
 	"git.sr.ht/~adnano/go-gemini"
 )
@@ -14,13 +17,101 @@ type ConvertedGmiDoc struct {
 	Title   string
 }
 
-func textToHTML(reqUrl *url.URL, text gemini.Text) ConvertedGmiDoc {
+// A Renderer converts parsed gemtext into another format
+type Renderer interface {
+	Render(text gemini.Text) ConvertedGmiDoc
+}
+
+// Called for each line before it is rendered. If it returns true, the hook
+// has written the line itself and the default rendering is skipped.
+type LineHook func(w io.Writer, line gemini.Line) bool
+
+type HTMLRenderer struct {
+	// Gemini URL of the page. Relative links are resolved against it and
+	// links off this instance go through the proxy. Nil for local pages.
+	BaseURL *url.URL
+	// Render links to images, audio and video on gemini or on this instance
+	// as media elements instead of links
+	InlineMedia bool
+	// Add a list of links to the headings, if there are several
+	TableOfContents bool
+	// Scheme for links to this instance and the proxy. Scheme relative if
+	// empty, which doesn't work outside of a browser.
+	Scheme string
+	// Close void elements, e.g. for EPUB
+	XHTML bool
+	// Customizes how lines are rendered, e.g. to embed content for certain
+	// links. See LineHook.
+	Hook LineHook
+}
+
+// The renderer used for pages on this instance
+func newHTMLRenderer(baseURL *url.URL) *HTMLRenderer {
+	return &HTMLRenderer{BaseURL: baseURL}
+}
+
+func textToHTML(reqUrl *url.URL, text gemini.Text, inlineMedia bool) ConvertedGmiDoc {
+	r := newHTMLRenderer(reqUrl)
+	r.InlineMedia = inlineMedia
+	return r.Render(text)
+}
+
+// Link extensions that can be shown inline, and the element to use
+var mediaElements = map[string]string{
+	".jpg":  "img",
+	".jpeg": "img",
+	".gif":  "img",
+	".png":  "img",
+	".svg":  "img",
+	".webp": "img",
+	".mp3":  "audio",
+	".ogg":  "audio",
+	".oga":  "audio",
+	".wav":  "audio",
+	".flac": "audio",
+	".opus": "audio",
+	".mp4":  "video",
+	".webm": "video",
+	".ogv":  "video",
+}
+
+type heading struct {
+	Level int
+	Text  string
+	Slug  string
+}
+
+// Make an id for a heading, e.g. "My Cool Page!" -> "my-cool-page"
+func slugify(text string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteRune('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	if b.Len() == 0 {
+		return "section"
+	}
+	return b.String()
+}
+
+func (r *HTMLRenderer) Render(text gemini.Text) ConvertedGmiDoc {
 	var b strings.Builder
 	var pre bool
 	var blockquote bool
 	var list bool
 	var title string
-	for _, l := range text {
+	var headings []heading
+	slugs := map[string]int{}
+	tocOffset := 0 // the table of contents goes after a leading h1
+	for i, l := range text {
 		if _, ok := l.(gemini.LineQuote); ok {
 			if !blockquote {
 				blockquote = true
@@ -39,38 +130,16 @@ func textToHTML(reqUrl *url.URL, text gemini.Text) ConvertedGmiDoc {
 			list = false
 			fmt.Fprint(&b, "</ul>\n")
 		}
-		switch l.(type) {
+		if r.Hook != nil && r.Hook(&b, l) {
+			continue
+		}
+		switch l := l.(type) {
 		case gemini.LineLink:
-			link := l.(gemini.LineLink)
-			urlstring := html.EscapeString(link.URL)
-			// u = ctx.URL.ResolveReference(u) ?
-			u, err := url.Parse(urlstring)
-			if err != nil {
-				continue
-			}
-			if reqUrl != nil {
-				u = reqUrl.ResolveReference(u)
-			}
-			if u.Scheme == "gemini" || (reqUrl != nil && u.Scheme == "") {
-				if strings.HasSuffix(u.Host, c.Host) {
-					u.Scheme = ""
-					urlstring = html.EscapeString(u.String())
-				} else {
-					u.Path = fmt.Sprintf("/%s%s", u.Host, u.Path)
-					u.Scheme = ""
-					u.Host = "proxy." + c.Host
-					urlstring = html.EscapeString(u.String())
-				}
-			}
-			name := html.EscapeString(link.Name)
-			if name == "" {
-				name = urlstring
-			}
-			fmt.Fprintf(&b, "<p><a href='%s'>%s</a></p>\n", urlstring, name)
+			r.renderLink(&b, l)
 		case gemini.LinePreformattingToggle:
 			pre = !pre
 			if pre {
-				altText := string(l.(gemini.LinePreformattingToggle))
+				altText := string(l)
 				if altText != "" {
 					altText = html.EscapeString(altText)
 					fmt.Fprintf(&b, "<pre title='%s'>\n", altText)
@@ -81,38 +150,41 @@ func textToHTML(reqUrl *url.URL, text gemini.Text) ConvertedGmiDoc {
 				fmt.Fprint(&b, "</pre>\n")
 			}
 		case gemini.LinePreformattedText:
-			text := string(l.(gemini.LinePreformattedText))
-			fmt.Fprintf(&b, "%s\n", html.EscapeString(text))
-		case gemini.LineHeading1:
-			text := string(l.(gemini.LineHeading1))
-			fmt.Fprintf(&b, "<h1>%s</h1>\n", html.EscapeString(text))
-			if title == "" {
-				title = text
-			} // TODO deal with repetition
-		case gemini.LineHeading2:
-			text := string(l.(gemini.LineHeading2))
-			fmt.Fprintf(&b, "<h2>%s</h2>\n", html.EscapeString(text))
-			if title == "" {
-				title = text
+			fmt.Fprintf(&b, "%s\n", html.EscapeString(string(l)))
+		case gemini.LineHeading1, gemini.LineHeading2, gemini.LineHeading3:
+			var h heading
+			switch l := l.(type) {
+			case gemini.LineHeading1:
+				h.Level, h.Text = 1, string(l)
+			case gemini.LineHeading2:
+				h.Level, h.Text = 2, string(l)
+			case gemini.LineHeading3:
+				h.Level, h.Text = 3, string(l)
 			}
-		case gemini.LineHeading3:
-			text := string(l.(gemini.LineHeading3))
-			fmt.Fprintf(&b, "<h3>%s</h3>\n", html.EscapeString(text))
+			h.Slug = slugify(h.Text)
+			slugs[h.Slug]++
+			if n := slugs[h.Slug]; n > 1 {
+				h.Slug = fmt.Sprintf("%s-%d", h.Slug, n)
+			}
+			headings = append(headings, h)
+			fmt.Fprintf(&b, "<h%d id='%s'>%s</h%d>\n", h.Level, html.EscapeString(h.Slug), html.EscapeString(h.Text), h.Level)
 			if title == "" {
-				title = text
+				title = h.Text
+			} // TODO deal with repetition
+			if i == 0 && h.Level == 1 {
+				tocOffset = b.Len()
 			}
 		case gemini.LineListItem:
-			text := string(l.(gemini.LineListItem))
-			fmt.Fprintf(&b, "<li>%s</li>\n", html.EscapeString(text))
+			fmt.Fprintf(&b, "<li>%s</li>\n", html.EscapeString(string(l)))
 		case gemini.LineQuote:
-			text := string(l.(gemini.LineQuote))
-			fmt.Fprintf(&b, "<p>%s</p>\n", html.EscapeString(text))
+			fmt.Fprintf(&b, "<p>%s</p>\n", html.EscapeString(string(l)))
 		case gemini.LineText:
-			text := string(l.(gemini.LineText))
-			if text == "" {
+			if l == "" && r.XHTML {
+				fmt.Fprint(&b, "<br />\n")
+			} else if l == "" {
 				fmt.Fprint(&b, "<br>\n")
 			} else {
-				fmt.Fprintf(&b, "<p>%s</p>\n", html.EscapeString(text))
+				fmt.Fprintf(&b, "<p>%s</p>\n", html.EscapeString(string(l)))
 			}
 		}
 	}
@@ -125,8 +197,83 @@ func textToHTML(reqUrl *url.URL, text gemini.Text) ConvertedGmiDoc {
 	if blockquote {
 		fmt.Fprint(&b, "</blockquote>\n")
 	}
+	content := b.String()
+	if tocOffset > 0 {
+		// Don't list the page title
+		headings = headings[1:]
+	}
+	if r.TableOfContents && len(headings) > 1 {
+		content = content[:tocOffset] + tableOfContents(headings) + content[tocOffset:]
+	}
 	return ConvertedGmiDoc{
-		b.String(),
+		content,
 		title,
 	}
 }
+
+func tableOfContents(headings []heading) string {
+	var b strings.Builder
+	fmt.Fprint(&b, "<nav class='toc'>\n<ul>\n")
+	for _, h := range headings {
+		fmt.Fprintf(&b, "<li class='toc-h%d'><a href='#%s'>%s</a></li>\n", h.Level, html.EscapeString(h.Slug), html.EscapeString(h.Text))
+	}
+	fmt.Fprint(&b, "</ul>\n</nav>\n")
+	return b.String()
+}
+
+// Links that would run code in the browser. They're shown as text.
+var unsafeLinkSchemes = map[string]bool{
+	"javascript": true,
+	"vbscript":   true,
+	"data":       true,
+}
+
+func (r *HTMLRenderer) renderLink(b io.Writer, link gemini.LineLink) {
+	u, err := url.Parse(link.URL)
+	if err != nil {
+		return
+	}
+	if unsafeLinkSchemes[strings.ToLower(u.Scheme)] {
+		name := link.Name
+		if name == "" {
+			name = link.URL
+		}
+		fmt.Fprintf(b, "<p>%s</p>\n", html.EscapeString(name))
+		return
+	}
+	if r.BaseURL != nil {
+		u = r.BaseURL.ResolveReference(u)
+	}
+	// Only media from this instance is inlined, not media through the proxy
+	local := u.Host == "" || isFlounderHost(u.Host)
+	if u.Scheme == "gemini" || (r.BaseURL != nil && u.Scheme == "") {
+		if local {
+			u.Scheme = r.Scheme
+		} else {
+			u.Path = fmt.Sprintf("/%s%s", u.Host, u.Path)
+			u.Scheme = r.Scheme
+			u.Host = "proxy." + c.Host
+		}
+	}
+	urlstring := html.EscapeString(u.String())
+	name := html.EscapeString(link.Name)
+	if name == "" {
+		name = urlstring
+	}
+	element := mediaElements[strings.ToLower(path.Ext(u.Path))]
+	if !r.InlineMedia || u.Scheme != r.Scheme || !local {
+		element = ""
+	}
+	closeVoid := ""
+	if r.XHTML {
+		closeVoid = " /"
+	}
+	switch element {
+	case "img":
+		fmt.Fprintf(b, "<p><a href='%s'><img src='%s' alt='%s'%s></a></p>\n", urlstring, urlstring, name, closeVoid)
+	case "audio", "video":
+		fmt.Fprintf(b, "<p><%s controls preload='metadata' src='%s' title='%s'><a href='%s'>%s</a></%s></p>\n", element, urlstring, name, urlstring, name, element)
+	default:
+		fmt.Fprintf(b, "<p><a href='%s'>%s</a></p>\n", urlstring, name)
+	}
+}
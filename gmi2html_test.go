@@ -0,0 +1,111 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~adnano/go-gemini"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// Each testdata/gmi2html/*.gmi file is rendered and compared against the
+// .html file next to it. Run with -update to regenerate them.
+func TestHTMLRendererGolden(t *testing.T) {
+	oldHost := c.Host
+	defer func() { c.Host = oldHost }()
+	c.Host = "flounder.local"
+	base, _ := url.Parse("gemini://example.com/dir/page.gmi")
+	renderers := map[string]*HTMLRenderer{
+		"proxied": {BaseURL: base},
+		"toc":     {TableOfContents: true},
+		"media":   {InlineMedia: true},
+	}
+	files, err := filepath.Glob("testdata/gmi2html/*.gmi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".gmi")
+		t.Run(name, func(t *testing.T) {
+			f, err := os.Open(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			text, err := gemini.ParseText(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r, ok := renderers[name]
+			if !ok {
+				r = &HTMLRenderer{}
+			}
+			got := r.Render(text).Content
+			golden := strings.TrimSuffix(file, ".gmi") + ".html"
+			if *update {
+				err = ioutil.WriteFile(golden, []byte(got), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("%s rendered as:\n%s\nwant:\n%s", file, got, want)
+			}
+		})
+	}
+}
+
+func TestHTMLRendererHook(t *testing.T) {
+	text, err := gemini.ParseText(strings.NewReader("# Title\n=> gemini://example.com/video Video\n=> other.gmi Other\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &HTMLRenderer{Hook: func(w io.Writer, line gemini.Line) bool {
+		link, ok := line.(gemini.LineLink)
+		if !ok || link.URL != "gemini://example.com/video" {
+			return false
+		}
+		fmt.Fprintf(w, "<p>Embedded %s</p>\n", link.Name)
+		return true
+	}}
+	want := "<h1 id='title'>Title</h1>\n<p>Embedded Video</p>\n<p><a href='other.gmi'>Other</a></p>\n"
+	if got := r.Render(text).Content; got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestSlugify(t *testing.T) {
+	for in, want := range map[string]string{
+		"My Cool Page!":   "my-cool-page",
+		"  spaces  ":      "spaces",
+		"Ünïcode heading": "ünïcode-heading",
+		"!!!":             "section",
+	} {
+		if got := slugify(in); got != want {
+			t.Errorf("slugify(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestMarkdownRenderer(t *testing.T) {
+	text, err := gemini.ParseText(strings.NewReader("# Title\n\n* one\n* two\n=> gemini://example.com/(a) [link]\n2021. was *good*\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# Title\n\n* one\n* two\n\n[\\[link\\]](gemini://example.com/%28a%29)\n\n2021\\. was \\*good\\*\n"
+	if got := (MarkdownRenderer{}).Render(text).Content; got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"database/sql"
+	"html/template"
+	"os"
+	"path"
+	"testing"
+)
+
+// A temporary folder for user files, with one for alex, and an empty
+// in-memory database. Call the function returned to put things back. Run
+// these with -race.
+func setupStorageTest(t *testing.T) func() {
+	oldConfig, oldStore, oldDB := c, store, DB
+	c.FilesDirectory = t.TempDir()
+	store = &LocalStorage{Root: c.FilesDirectory}
+	DB, _ = sql.Open(sqliteDriver, ":memory:")
+	// Each connection would get its own database
+	DB.SetMaxOpenConns(1)
+	createTablesIfDNE()
+	c.MaxFileBytes = 100
+	c.MaxUserBytes = 1000
+	c.MaxFilesPerUser = 100
+	c.OkExtensions = []string{".gmi"}
+	c.Host = "flounder.online"
+	os.Mkdir(path.Join(c.FilesDirectory, "alex"), os.ModePerm)
+	return func() {
+		DB.Close()
+		c, store, DB = oldConfig, oldStore, oldDB
+	}
+}
+
+// Add a user, with a folder for their files
+func addTestUser(t *testing.T, username string, active bool) {
+	t.Helper()
+	_, err := DB.Exec("INSERT INTO user (username, email, password_hash, active) VALUES (?, ?, '', ?)",
+		username, username+"@example.com", active)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(path.Join(c.FilesDirectory, username), os.ModePerm)
+}
+
+// Just enough templates for handlers that render errors. Call the function
+// returned to put things back.
+func setupErrorTemplate() func() {
+	old := t
+	t = template.Must(template.New("main").Parse(`{{define "error.html"}}{{.ErrorMsg}}{{end}}`))
+	return func() { t = old }
+}
@@ -2,21 +2,23 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	gmi "git.sr.ht/~adnano/go-gemini"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/sessions"
-	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/bcrypt"
 	"html/template"
 	"io"
-	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -61,22 +63,37 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	user := getAuthUser(r)
-	indexFiles, err := getIndexFiles(user.IsAdmin)
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	indexFiles, hasMore, err := getIndexFiles(user.IsAdmin, page)
 	if err != nil {
 		serverError(w, err)
 		return
 	}
-	allUsers, err := getActiveUserNames()
+	allUsers, err := getListedUserNames()
 	if err != nil {
 		serverError(w, err)
 		return
 	}
+	siteTitles, err := getSiteTitles()
+	if err != nil {
+		log.Println(err)
+	}
+	var nextPage int
+	if hasMore {
+		nextPage = page + 1
+	}
 	data := struct {
-		Config   Config
-		AuthUser AuthUser
-		Files    []*File
-		Users    []string
-	}{c, user, indexFiles, allUsers}
+		Config     Config
+		AuthUser   AuthUser
+		Files      []*File
+		Users      []string
+		SiteTitles map[string]string
+		PrevPage   int
+		NextPage   int
+	}{c, user, indexFiles, allUsers, siteTitles, page - 1, nextPage}
 	err = t.ExecuteTemplate(w, "index.html", data)
 	if err != nil {
 		serverError(w, err)
@@ -91,20 +108,26 @@ func editFileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	fileName := filepath.Clean(r.URL.Path[len("/edit/"):])
-	filePath := path.Join(c.FilesDirectory, user.Username, fileName)
+	filePath := userFilePath(user.Username, fileName)
 	isText := isTextFile(filePath)
 	alert := ""
 	var warnings []string
 	if r.Method == "POST" {
 		// get post body
 		alert = "saved"
-		r.ParseForm()
+		// Allow for the form encoding, writeUserFile enforces the real limit
+		r.Body = http.MaxBytesReader(w, r.Body, 3*int64(c.MaxFileBytes)+4096)
+		err := r.ParseForm()
+		if err != nil {
+			renderError(w, "File too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		fileText := r.Form.Get("file_text")
 		// Web form by default gives us CR LF newlines.
 		// Unix files use just LF
 		fileText = strings.ReplaceAll(fileText, "\r\n", "\n")
 		fileBytes := []byte(fileText)
-		err := checkIfValidFile(user.Username, filePath, fileBytes)
+		err = checkIfValidFile(user.Username, fileName, fileBytes)
 		if err != nil {
 			log.Println(err)
 			renderError(w, err.Error(), http.StatusBadRequest)
@@ -117,8 +140,12 @@ func editFileHandler(w http.ResponseWriter, r *http.Request) {
 				warnings = append(warnings, l)
 			}
 		}
-		// create directories if dne
-		os.MkdirAll(path.Dir(filePath), os.ModePerm)
+		if isGemini(fileName) {
+			text, _ := gmi.ParseText(strings.NewReader(fileText))
+			for _, l := range checkLinks(user.Username, fileName, text) {
+				warnings = append(warnings, fmt.Sprintf("Broken link on line %d to %s: %s", l.Line, l.URL, l.Reason))
+			}
+		}
 		newName := filepath.Clean(r.Form.Get("rename"))
 		err = checkIfValidFile(user.Username, newName, fileBytes)
 		if err != nil {
@@ -126,43 +153,67 @@ func editFileHandler(w http.ResponseWriter, r *http.Request) {
 			renderError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if newState, ok := parseFileState(r.Form); ok {
+			// Set before writing, so a new draft is never public
+			err = setFileState(user.Username, fileName, newState)
+			if err != nil {
+				log.Println(err)
+				renderError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
 		if isText { // Cant edit binary files here
-			err = ioutil.WriteFile(filePath, fileBytes, 0644)
+			err = writeUserFile(user.Username, fileName, bytes.NewReader(fileBytes))
 			if err != nil {
 				log.Println(err)
 				renderError(w, err.Error(), http.StatusBadRequest)
+				return
 			}
 		}
 		if newName != fileName {
-			newPath := path.Join(c.FilesDirectory, user.Username, newName)
-			os.MkdirAll(path.Dir(newPath), os.ModePerm)
-			os.Rename(filePath, newPath)
+			err = renameUserFile(user.Username, fileName, newName)
+			if err != nil {
+				log.Println(err)
+				renderError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 			fileName = newName
-			filePath = newPath
+			filePath = userFilePath(user.Username, newName)
 			alert += " and renamed"
 		}
 	}
 
-	err := checkIfValidFile(user.Username, filePath, nil)
+	err := checkIfValidFile(user.Username, fileName, nil)
 	if err != nil {
 		log.Println(err)
 		renderError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	// Create directories if dne
-	f, err := os.OpenFile(filePath, os.O_RDONLY, 0644)
+	f, err := store.Open(filePath)
 	var fileBytes []byte
-	if os.IsNotExist(err) || !isText {
+	if os.IsNotExist(err) && cleanStorageName(fileName) == siteConfigFile {
+		fileBytes = []byte(exampleSiteConfig)
+		err = nil
+	} else if os.IsNotExist(err) || !isText {
 		fileBytes = []byte{}
 		err = nil
-	} else {
+	} else if err == nil {
 		defer f.Close()
-		fileBytes, err = ioutil.ReadAll(f)
+		fileBytes, err = readLimited(f)
 	}
 	if err != nil {
-		serverError(w, err)
+		log.Println(err)
+		renderError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	state, err := getFileState(user.Username, fileName)
+	if err != nil {
+		log.Println(err)
+	}
+	files, err := getLinkableFiles(user.Username)
+	if err != nil {
+		log.Println(err)
+	}
 	data := struct {
 		FileName string
 		FileText string
@@ -172,9 +223,11 @@ func editFileHandler(w http.ResponseWriter, r *http.Request) {
 		IsText   bool
 		IsGemini bool
 		IsGemlog bool
+		State    *FileState
+		Files    []string // for the link picker
 		Alert    string
 		Warnings []string
-	}{fileName, string(fileBytes), c, user, c.Host, isText, isGemini(fileName), strings.HasPrefix(fileName, "gemlog"), alert, warnings}
+	}{fileName, string(fileBytes), c, user, c.Host, isText, isGemini(fileName), strings.HasPrefix(fileName, "gemlog"), state, files, alert, warnings}
 	err = t.ExecuteTemplate(w, "edit_file.html", data)
 	if err != nil {
 		serverError(w, err)
@@ -182,6 +235,52 @@ func editFileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Render the text being edited without saving it, with any broken links.
+// With ?partial only the rendered page and problems are sent, for the live
+// preview on the edit page.
+func previewHandler(w http.ResponseWriter, r *http.Request) {
+	user := getAuthUser(r)
+	if !user.LoggedIn {
+		renderDefaultError(w, http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		renderDefaultError(w, http.StatusMethodNotAllowed)
+		return
+	}
+	fileName := cleanStorageName(strings.TrimPrefix(r.URL.Path, "/preview/"))
+	r.Body = http.MaxBytesReader(w, r.Body, 3*int64(c.MaxFileBytes)+4096)
+	err := r.ParseForm()
+	if err != nil {
+		renderError(w, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	fileText := strings.ReplaceAll(r.Form.Get("file_text"), "\r\n", "\n")
+	text, err := gmi.ParseText(strings.NewReader(fileText))
+	if err != nil {
+		renderError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Relative links go to the user's site
+	base := &url.URL{Scheme: "gemini", Host: user.Username + "." + c.Host, Path: "/" + fileName}
+	htmlDoc := textToHTML(base, text, wantsInlineMedia(user.Username))
+	data := struct {
+		FileName    string
+		Rendered    template.HTML
+		BrokenLinks []BrokenLink
+		Config      Config
+		AuthUser    AuthUser
+	}{fileName, template.HTML(htmlDoc.Content), checkLinks(user.Username, fileName, text), c, user}
+	name := "preview.html"
+	if _, partial := r.URL.Query()["partial"]; partial {
+		name = "preview_body"
+	}
+	err = t.ExecuteTemplate(w, name, data)
+	if err != nil {
+		serverError(w, err)
+	}
+}
+
 func uploadFilesHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
 		user := getAuthUser(r)
@@ -189,33 +288,103 @@ func uploadFilesHandler(w http.ResponseWriter, r *http.Request) {
 			renderDefaultError(w, http.StatusForbidden)
 			return
 		}
-		r.ParseMultipartForm(10 << 6) // why does this not work
-		file, fileHeader, err := r.FormFile("file")
+		r.Body = http.MaxBytesReader(w, r.Body, c.MaxUserBytes)
+		err := r.ParseMultipartForm(int64(c.MaxFileBytes))
 		if err != nil {
 			log.Println(err)
+			renderError(w, "Upload failed. It may be larger than your storage space.", http.StatusBadRequest)
+			return
+		}
+		fileHeaders := r.MultipartForm.File["file"]
+		if len(fileHeaders) == 0 {
 			renderError(w, "No file selected. Please go back and select a file.", http.StatusBadRequest)
 			return
 		}
-		fileName := filepath.Clean(fileHeader.Filename)
-		defer file.Close()
-		dest, _ := ioutil.ReadAll(file)
-		err = checkIfValidFile(user.Username, fileName, dest)
-		if err != nil {
-			log.Println(err)
-			renderError(w, err.Error(), http.StatusBadRequest)
+		opts := extractOptions{
+			DryRun:    r.FormValue("dry-run") != "",
+			Overwrite: r.FormValue("overwrite") != "",
+			Import:    r.FormValue("import") != "",
+		}
+		extract := r.FormValue("extract") != ""
+		var results []uploadResult
+		// Plain uploads go straight back to the site page if they worked
+		showResults := opts.DryRun
+		for _, fileHeader := range fileHeaders {
+			if extract && isArchive(fileHeader.Filename) {
+				showResults = true
+			}
+			results = append(results, uploadFile(user.Username, fileHeader, extract, opts)...)
+		}
+		for _, result := range results {
+			if result.Error != "" {
+				showResults = true
+			}
+		}
+		if showResults {
+			data := struct {
+				Config   Config
+				AuthUser AuthUser
+				Results  []uploadResult
+				DryRun   bool
+			}{c, user, results, opts.DryRun}
+			err = t.ExecuteTemplate(w, "upload_results.html", data)
+			if err != nil {
+				serverError(w, err)
+			}
 			return
 		}
-		destPath := path.Join(c.FilesDirectory, user.Username, fileName)
+	}
+	http.Redirect(w, r, "/my_site", http.StatusSeeOther)
+}
 
-		f, err := os.OpenFile(destPath, os.O_WRONLY|os.O_CREATE, 0644)
+// Save one uploaded file, or extract it if it's an archive
+func uploadFile(username string, fileHeader *multipart.FileHeader, extract bool, opts extractOptions) []uploadResult {
+	result := uploadResult{Name: fileHeader.Filename}
+	file, err := fileHeader.Open()
+	if err != nil {
+		result.Error = err.Error()
+		return []uploadResult{result}
+	}
+	defer file.Close()
+	fileName := filepath.Clean(fileHeader.Filename)
+	if extract && isArchive(fileName) {
+		results, err := extractArchive(username, fileName, file, fileHeader.Size, opts)
 		if err != nil {
-			serverError(w, err)
-			return
+			log.Println(err)
+			result.Error = err.Error()
+			results = append(results, result)
 		}
-		defer f.Close()
-		io.Copy(f, bytes.NewReader(dest))
+		return results
 	}
-	http.Redirect(w, r, "/my_site", http.StatusSeeOther)
+	var body io.Reader = file
+	size := fileHeader.Size
+	if opts.Import && canImport(fileName) {
+		var dest []byte
+		dest, err = readLimited(file)
+		if err == nil {
+			fileName, dest, err = importToGemtext(fileName, dest)
+		}
+		if err != nil {
+			log.Println(err)
+			result.Error = "Could not convert file: " + err.Error()
+			return []uploadResult{result}
+		}
+		body, size = bytes.NewReader(dest), int64(len(dest))
+	}
+	result.Name = fileName
+	if opts.DryRun {
+		err = checkUserFile(username, fileName, size)
+		result.Status = "would be written"
+	} else {
+		err = writeUserFile(username, fileName, body)
+		result.Status = "written"
+	}
+	if err != nil {
+		log.Println(err)
+		result.Status = ""
+		result.Error = err.Error()
+	}
+	return []uploadResult{result}
 }
 
 type AuthUser struct {
@@ -247,14 +416,169 @@ func mySiteHandler(w http.ResponseWriter, r *http.Request) {
 	// check auth
 	userFolder := getUserDirectory(user.Username)
 	files, _ := getMyFilesRecursive(userFolder, user.Username)
+	usage, err := getUserUsage(user.Username)
+	if err != nil {
+		log.Println(err)
+	}
+	states, err := getFileStates(user.Username)
+	if err != nil {
+		log.Println(err)
+	}
+	markFileStates(files, states)
+	mentions, err := getRecentMentions(user.Username, 10)
+	if err != nil {
+		log.Println(err)
+	}
+	brokenLinks, err := getBrokenLinks(user.Username)
+	if err != nil {
+		log.Println(err)
+	}
+	siteConfigError, err := getSiteConfigError(user.Username)
+	if err != nil {
+		log.Println(err)
+	}
 	currentDate := time.Now().Format("2006-01-02")
+	data := struct {
+		Config          Config
+		Files           []File
+		AuthUser        AuthUser
+		CurrentDate     string
+		Usage           Usage
+		Mentions        []Mention
+		BrokenLinks     []BrokenLinkReport
+		SiteConfigError string
+	}{c, files, user, currentDate, usage, mentions, brokenLinks, siteConfigError}
+	_ = t.ExecuteTemplate(w, "my_site.html", data)
+}
+
+// Check the user's site for broken links now, instead of waiting for the
+// background check
+func checkLinksHandler(w http.ResponseWriter, r *http.Request) {
+	user := getAuthUser(r)
+	if !user.LoggedIn {
+		renderDefaultError(w, http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		renderDefaultError(w, http.StatusMethodNotAllowed)
+		return
+	}
+	_, err := checkSiteLinks(user.Username)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	http.Redirect(w, r, "/my_site#broken-links", http.StatusSeeOther)
+}
+
+// Change the site's stylesheet, favicon, header, footer and title format
+func themeHandler(w http.ResponseWriter, r *http.Request) {
+	user := getAuthUser(r)
+	if !user.LoggedIn {
+		renderDefaultError(w, http.StatusForbidden)
+		return
+	}
+	if !c.CustomThemes {
+		renderError(w, "Custom themes are disabled on this instance", http.StatusNotFound)
+		return
+	}
+	var errors []string
+	if r.Method == "POST" {
+		r.ParseForm()
+		theme := SiteTheme{
+			Stylesheet:  r.Form.Get("stylesheet"),
+			Favicon:     r.Form.Get("favicon"),
+			TitleFormat: r.Form.Get("title_format"),
+			Header:      r.Form.Get("header"),
+			Footer:      r.Form.Get("footer"),
+		}
+		err := setSiteTheme(user.Username, theme)
+		if err != nil {
+			errors = append(errors, err.Error())
+		} else {
+			http.Redirect(w, r, "/my_site/theme", http.StatusSeeOther)
+			return
+		}
+	}
+	theme, err := getSiteTheme(user.Username)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	files, err := getLinkableFiles(user.Username)
+	if err != nil {
+		log.Println(err)
+	}
+	var stylesheets, images []string
+	for _, name := range files {
+		ext := strings.ToLower(path.Ext(name))
+		if ext == ".css" {
+			stylesheets = append(stylesheets, name)
+		} else if faviconExtensions[ext] {
+			images = append(images, name)
+		}
+	}
 	data := struct {
 		Config      Config
-		Files       []File
 		AuthUser    AuthUser
-		CurrentDate string
-	}{c, files, user, currentDate}
-	_ = t.ExecuteTemplate(w, "my_site.html", data)
+		Theme       *SiteTheme
+		Stylesheets []string
+		Images      []string
+		Errors      []string
+	}{c, user, theme, stylesheets, images, errors}
+	err = t.ExecuteTemplate(w, "theme.html", data)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+}
+
+// List and change the folders published as feeds
+func feedsHandler(w http.ResponseWriter, r *http.Request) {
+	user := getAuthUser(r)
+	if !user.LoggedIn {
+		renderDefaultError(w, http.StatusForbidden)
+		return
+	}
+	var errors []string
+	if r.Method == "POST" {
+		r.ParseForm()
+		folder := FeedFolder{
+			Folder:      r.Form.Get("folder"),
+			Title:       r.Form.Get("title"),
+			Author:      r.Form.Get("author"),
+			Description: r.Form.Get("description"),
+		}
+		var err error
+		if r.Form.Get("delete") != "" {
+			err = deleteFeedFolder(user.Username, folder.Folder)
+		} else {
+			err = setFeedFolder(user.Username, folder)
+		}
+		if err != nil {
+			errors = append(errors, err.Error())
+		} else {
+			http.Redirect(w, r, "/my_site/feeds", http.StatusSeeOther)
+			return
+		}
+	}
+	folders, err := getFeedFolders(user.Username)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	data := struct {
+		Config   Config
+		AuthUser AuthUser
+		Feeds    []FeedFolder
+		Gemlog   string
+		Errors   []string
+	}{c, user, folders, GemlogFolder, errors}
+	err = t.ExecuteTemplate(w, "feeds.html", data)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
 }
 
 func myAccountHandler(w http.ResponseWriter, r *http.Request) {
@@ -266,12 +590,17 @@ func myAccountHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	me, _ := getUserByName(user.Username)
 	type pageData struct {
-		Config   Config
-		AuthUser AuthUser
-		MyUser   *User
-		Errors   []string
+		Config       Config
+		AuthUser     AuthUser
+		MyUser       *User
+		ListedBySite bool // site.toml sets listed, overriding MyUser.Listed
+		SiteListed   bool
+		Errors       []string
+	}
+	data := pageData{c, user, me, false, false, nil}
+	if listed := getSiteConfig(user.Username).Listed; listed != nil {
+		data.ListedBySite, data.SiteListed = true, *listed
 	}
-	data := pageData{c, user, me, nil}
 
 	if r.Method == "GET" {
 		err := t.ExecuteTemplate(w, "me.html", data)
@@ -285,6 +614,11 @@ func myAccountHandler(w http.ResponseWriter, r *http.Request) {
 		errors := []string{}
 		newEmail := r.Form.Get("email")
 		newDomain := r.Form.Get("domain")
+		newInlineMedia := r.Form.Get("inline_media") == "on"
+		newTableOfContents := r.Form.Get("table_of_contents") == "on"
+		newListed := r.Form.Get("listed") == "on"
+		newInPlanet := r.Form.Get("in_planet") == "on"
+		newShowMentions := r.Form.Get("show_mentions") == "on"
 		newUsername = strings.ToLower(newUsername)
 		var err error
 		_, exists := domains[newDomain]
@@ -306,6 +640,47 @@ func myAccountHandler(w http.ResponseWriter, r *http.Request) {
 				log.Printf("Changed email for %s from %s to %s", authUser, me.Email, newEmail)
 			}
 		}
+		if c.InlineMedia && newInlineMedia != me.InlineMedia {
+			_, err = DB.Exec("update user set inline_media = ? where username = ?", newInlineMedia, me.Username)
+			if err != nil {
+				errors = append(errors, err.Error())
+			} else {
+				data.MyUser.InlineMedia = newInlineMedia
+			}
+		}
+		if newTableOfContents != me.TableOfContents {
+			_, err = DB.Exec("update user set table_of_contents = ? where username = ?", newTableOfContents, me.Username)
+			if err != nil {
+				errors = append(errors, err.Error())
+			} else {
+				data.MyUser.TableOfContents = newTableOfContents
+			}
+		}
+		// The checkbox is disabled while site.toml decides
+		if !data.ListedBySite && newListed != me.Listed {
+			_, err = DB.Exec("update user set listed = ? where username = ?", newListed, me.Username)
+			if err != nil {
+				errors = append(errors, err.Error())
+			} else {
+				data.MyUser.Listed = newListed
+			}
+		}
+		if newInPlanet != me.InPlanet {
+			_, err = DB.Exec("update user set in_planet = ? where username = ?", newInPlanet, me.Username)
+			if err != nil {
+				errors = append(errors, err.Error())
+			} else {
+				data.MyUser.InPlanet = newInPlanet
+			}
+		}
+		if newShowMentions != me.ShowMentions {
+			_, err = DB.Exec("update user set show_mentions = ? where username = ?", newShowMentions, me.Username)
+			if err != nil {
+				errors = append(errors, err.Error())
+			} else {
+				data.MyUser.ShowMentions = newShowMentions
+			}
+		}
 		if newUsername != authUser {
 			// Rename User
 			err = renameUser(authUser, newUsername)
@@ -344,6 +719,98 @@ func archiveHandler(w http.ResponseWriter, r *http.Request) {
 
 	}
 }
+
+// Recent gemlog posts from everyone, with feeds at /planet/atom.xml etc
+func planetHandler(w http.ResponseWriter, r *http.Request) {
+	if base := strings.TrimPrefix(r.URL.Path, "/planet/"); feedFiles[base] != "" {
+		feed, err := generatePlanetFeed()
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		serveFeed(w, r, feed, feedFiles[base])
+		return
+	} else if r.URL.Path != "/planet" {
+		renderDefaultError(w, http.StatusNotFound)
+		return
+	}
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	entries, hasMore, err := getPlanetEntries(page)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	var nextPage int
+	if hasMore {
+		nextPage = page + 1
+	}
+	data := struct {
+		Config   Config
+		AuthUser AuthUser
+		Entries  []FeedEntry
+		PrevPage int
+		NextPage int
+	}{c, getAuthUser(r), entries, page - 1, nextPage}
+	err = t.ExecuteTemplate(w, "planet.html", data)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+}
+
+// Search all listed sites, or one site with ?site=
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	user := getAuthUser(r)
+	q := r.URL.Query().Get("q")
+	site := r.URL.Query().Get("site")
+	results, err := searchFiles(q, site)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	data := struct {
+		Config   Config
+		AuthUser AuthUser
+		Query    string
+		Site     string
+		Results  []SearchResult
+	}{c, user, q, site, results}
+	err = t.ExecuteTemplate(w, "search.html", data)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+}
+
+func epubHandler(w http.ResponseWriter, r *http.Request) {
+	authUser := getAuthUser(r)
+	if !authUser.LoggedIn {
+		renderDefaultError(w, http.StatusForbidden)
+		return
+	}
+	feed := generateFeedFromUser(authUser.Username)
+	if feed == nil || len(feed.Entries) == 0 {
+		renderError(w, "Your gemlog has no posts yet", http.StatusNotFound)
+		return
+	}
+	language := getSiteConfig(authUser.Username).Language
+	if language == "" {
+		language = "en"
+	}
+	buff := bytes.NewBuffer([]byte{})
+	err := buildEpub(feed, language, buff)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/epub+zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+authUser.Username+"-gemlog.epub\"")
+	w.Write(buff.Bytes())
+}
+
 func loginHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		// show page
@@ -429,7 +896,7 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			errors = append(errors, err.Error())
 		}
-		_, err = os.Stat(getUserDirectory(username))
+		_, err = store.Stat(getUserDirectory(username))
 		if !os.IsNotExist(err) {
 			// Don't allow user to create account if folder dne
 			errors = append(errors, "Invalid username")
@@ -470,9 +937,11 @@ func deleteFileHandler(w http.ResponseWriter, r *http.Request) {
 		renderDefaultError(w, http.StatusForbidden)
 		return
 	}
-	filePath := safeGetFilePath(user.Username, r.URL.Path[len("/delete/"):])
 	if r.Method == "POST" {
-		os.Remove(filePath) // TODO handle error
+		err := deleteUserFile(user.Username, r.URL.Path[len("/delete/"):])
+		if err != nil {
+			log.Println(err)
+		}
 	}
 	http.Redirect(w, r, "/my_site", http.StatusSeeOther)
 }
@@ -489,11 +958,17 @@ func adminHandler(w http.ResponseWriter, r *http.Request) {
 		renderDefaultError(w, http.StatusInternalServerError)
 		return
 	}
+	knownHosts, err := getKnownHosts()
+	if err != nil {
+		serverError(w, err)
+		return
+	}
 	data := struct {
-		Users    []User
-		AuthUser AuthUser
-		Config   Config
-	}{allUsers, user, c}
+		Users      []User
+		KnownHosts []KnownHost
+		AuthUser   AuthUser
+		Config     Config
+	}{allUsers, knownHosts, user, c}
 	err = t.ExecuteTemplate(w, "admin.html", data)
 	if err != nil {
 		serverError(w, err)
@@ -501,6 +976,24 @@ func adminHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Serve a feed with an ETag and Last-Modified, so readers can poll it
+// cheaply
+func serveFeed(w http.ResponseWriter, r *http.Request, feed *Gemfeed, format string) {
+	if feed == nil {
+		renderDefaultError(w, http.StatusNotFound)
+		return
+	}
+	body, err := feed.render(format, "https")
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	sum := sha256.Sum256([]byte(body))
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Content-Type", feedContentTypes[format])
+	http.ServeContent(w, r, "", feed.Updated, strings.NewReader(body))
+}
+
 // Server a user's file
 // TODO replace with gemini proxy
 // Here be dragons
@@ -514,8 +1007,8 @@ func userFile(w http.ResponseWriter, r *http.Request) {
 	}
 	p := filepath.Clean(r.URL.Path)
 	var isDir bool
-	fullPath := path.Join(c.FilesDirectory, userName, p) // TODO rename filepath
-	stat, err := os.Stat(fullPath)
+	fullPath := path.Join(getUserDirectory(userName), p) // TODO rename filepath
+	stat, err := store.Stat(fullPath)
 	if stat != nil {
 		isDir = stat.IsDir()
 	}
@@ -528,25 +1021,23 @@ func userFile(w http.ResponseWriter, r *http.Request) {
 		renderDefaultError(w, http.StatusForbidden)
 		return
 	}
-	if r.URL.Path == "/gemlog/atom.xml" && os.IsNotExist(err) {
-		w.Header().Set("Content-Type", "application/atom+xml")
-		// TODO set always somehow
-		feed := generateFeedFromUser(userName)
-		atomString := feed.toAtomFeed()
-		io.Copy(w, strings.NewReader(atomString))
-		return
+	if dir, base := path.Split(p); feedFiles[base] != "" && os.IsNotExist(err) {
+		if folder, _ := getFeedFolder(userName, dir); folder != nil {
+			serveFeed(w, r, generateFeedFromFolder(userName, folder), feedFiles[base])
+			return
+		}
 	}
 
 	var geminiContent string
-	fullStat, err := os.Stat(path.Join(fullPath, "index.gmi"))
+	fullStat, err := store.Stat(path.Join(fullPath, "index.gmi"))
 	if isDir {
 		// redirect slash
 		if !strings.HasSuffix(r.URL.Path, "/") {
 			http.Redirect(w, r, p+"/", http.StatusSeeOther)
 		}
 		if os.IsNotExist(err) {
-			if p == "/gemlog" {
-				geminiContent = generateGemfeedPage(userName)
+			if folder, _ := getFeedFolder(userName, p); folder != nil {
+				geminiContent = generateGemfeedPage(userName, folder)
 			} else {
 				geminiContent = generateFolderPage(fullPath)
 			}
@@ -557,7 +1048,7 @@ func userFile(w http.ResponseWriter, r *http.Request) {
 			stat = fullStat // wonky
 		}
 	}
-	if geminiContent == "" && os.IsNotExist(err) {
+	if geminiContent == "" && (os.IsNotExist(err) || !isPublished(userName, getLocalPath(fullPath))) {
 		renderDefaultError(w, http.StatusNotFound)
 		return
 	}
@@ -565,32 +1056,77 @@ func userFile(w http.ResponseWriter, r *http.Request) {
 	_, raw := r.URL.Query()["raw"]
 	acceptsGemini := strings.Contains(r.Header.Get("Accept"), "text/gemini")
 	if !raw && !acceptsGemini && (isGemini(fullPath) || geminiContent != "") {
-		var htmlDoc ConvertedGmiDoc
+		var parse gmi.Text
 		if geminiContent == "" {
-			file, _ := os.Open(fullPath)
-			parse, _ := gmi.ParseText(file)
-			htmlDoc = textToHTML(nil, parse)
+			file, err := store.Open(fullPath)
+			if err != nil {
+				serverError(w, err)
+				return
+			}
+			parse, _ = gmi.ParseText(file)
 			defer file.Close()
 		} else {
-			parse, _ := gmi.ParseText(strings.NewReader(geminiContent))
-			htmlDoc = textToHTML(nil, parse)
+			parse, _ = gmi.ParseText(strings.NewReader(geminiContent))
+		}
+		format := r.URL.Query().Get("format")
+		if _, ok := feedContentTypes[format]; ok {
+			serveFeed(w, r, generateFeedFromPage(userName, fullPath, parse), format)
+			return
+		}
+		if exporter, contentType := exportRenderer(format); exporter != nil {
+			w.Header().Set("Content-Type", contentType)
+			doc := exporter.Render(parse)
+			http.ServeContent(w, r, "", stat.ModTime(), strings.NewReader(doc.Content))
+			return
+		}
+		renderer := newHTMLRenderer(nil)
+		modTime := stat.ModTime()
+		if owner, err := getUserByName(userName); err == nil {
+			renderer.InlineMedia = c.InlineMedia && owner.InlineMedia
+			renderer.TableOfContents = owner.TableOfContents
+			if geminiContent == "" {
+				parse, modTime = appendMentions(owner, getLocalPath(fullPath), parse, modTime)
+			}
 		}
+		htmlDoc := renderer.Render(parse)
 		hostname := strings.Split(r.Host, ":")[0]
 		uri := url.URL{
 			Scheme: "gemini",
 			Host:   hostname,
 			Path:   p,
 		}
-		if htmlDoc.Title == "" {
+		site := getSiteConfig(userName)
+		if htmlDoc.Title == "" && p == "/" && site.Title != "" {
+			htmlDoc.Title = site.Title
+		} else if htmlDoc.Title == "" {
 			htmlDoc.Title = userName + p
 		}
+		feeds, err := getFeedFolders(userName)
+		if err != nil {
+			log.Println(err)
+		}
+		for i := range feeds {
+			if feeds[i].Title == "" {
+				feeds[i].Title = defaultFeedTitle(userName, feeds[i].Folder)
+			}
+		}
+		theme := pageTheme(userName)
+		siteName := hostname
+		if site.Title != "" {
+			siteName = site.Title
+		}
 		data := struct {
-			SiteBody  template.HTML
-			PageTitle string
-			URI       *url.URL
-			GeminiURI *url.URL
-			Config    Config
-		}{template.HTML(htmlDoc.Content), htmlDoc.Title, &uri, &uri, c}
+			SiteBody    template.HTML
+			PageTitle   string
+			Lang        string
+			URI         *url.URL
+			GeminiURI   *url.URL
+			Feeds       []FeedFolder
+			Webmentions bool // advertise the endpoint
+			Theme       *SiteTheme
+			Site        *SiteConfig
+			Config      Config
+		}{template.HTML(htmlDoc.Content), theme.PageTitle(htmlDoc.Title, siteName), site.Language, &uri, &uri, feeds, c.Webmentions, theme, site, c}
 		buff := bytes.NewBuffer([]byte{})
 		err = t.ExecuteTemplate(buff, "user_page.html", data)
 		if err != nil {
@@ -598,9 +1134,17 @@ func userFile(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		breader := bytes.NewReader(buff.Bytes())
-		http.ServeContent(w, r, "", stat.ModTime(), breader)
+		http.ServeContent(w, r, "", modTime, breader)
 	} else {
-		http.ServeFile(w, r, fullPath)
+		file, err := store.Open(fullPath)
+		if err != nil {
+			serverError(w, err)
+			return
+		}
+		defer file.Close()
+		// e.g. so stylesheets are only used as stylesheets
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		http.ServeContent(w, r, path.Base(fullPath), stat.ModTime(), file)
 	}
 }
 
@@ -713,6 +1257,24 @@ func adminUserHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func adminProxyHostHandler(w http.ResponseWriter, r *http.Request) {
+	user := getAuthUser(r)
+	if r.Method == "POST" {
+		if !user.IsAdmin {
+			renderDefaultError(w, http.StatusForbidden)
+			return
+		}
+		r.ParseForm()
+		err := forgetKnownHost(r.Form.Get("hostname"))
+		if err != nil {
+			renderError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("User %s cleared proxy certificate for %s", user.Username, r.Form.Get("hostname"))
+	}
+	http.Redirect(w, r, "/admin", http.StatusSeeOther)
+}
+
 func checkDomainHandler(w http.ResponseWriter, r *http.Request) {
 	domain := r.URL.Query().Get("domain")
 	if domain != "" && domains[domain] != "" {
@@ -731,6 +1293,7 @@ func runHTTPServer() {
 	t = template.New("main").Funcs(template.FuncMap{
 		"unixTime": time.Unix,
 		"parent":   path.Dir, "hasSuffix": strings.HasSuffix,
+		"byteSize": byteSize,
 		"safeGeminiURL": func(u string) template.URL {
 			if strings.HasPrefix(u, "gemini://") {
 				return template.URL(u)
@@ -750,8 +1313,20 @@ func runHTTPServer() {
 	serveMux.HandleFunc(hostname+"/my_site", mySiteHandler)
 	serveMux.HandleFunc(hostname+"/me", myAccountHandler)
 	serveMux.HandleFunc(hostname+"/my_site/flounder-archive.zip", archiveHandler)
+	serveMux.HandleFunc(hostname+"/my_site/gemlog.epub", epubHandler)
+	serveMux.HandleFunc(hostname+"/my_site/feeds", feedsHandler)
+	serveMux.HandleFunc(hostname+"/my_site/check-links", checkLinksHandler)
+	serveMux.HandleFunc(hostname+"/my_site/theme", themeHandler)
 	serveMux.HandleFunc(hostname+"/admin", adminHandler)
+	serveMux.HandleFunc(hostname+"/search", searchHandler)
+	serveMux.HandleFunc(hostname+"/planet", planetHandler)
+	serveMux.HandleFunc(hostname+"/planet/", planetHandler)
+	serveMux.HandleFunc(hostname+"/timeline", timelineHandler)
+	serveMux.HandleFunc(hostname+"/subscriptions", subscriptionsHandler)
+	serveMux.HandleFunc(hostname+"/subscriptions/", subscriptionsHandler)
+	serveMux.HandleFunc(hostname+"/webmention", webmentionHandler)
 	serveMux.HandleFunc(hostname+"/edit/", editFileHandler)
+	serveMux.HandleFunc(hostname+"/preview/", previewHandler)
 	serveMux.HandleFunc(hostname+"/upload", uploadFilesHandler)
 	serveMux.Handle(hostname+"/login", limit(http.HandlerFunc(loginHandler)))
 	serveMux.Handle(hostname+"/register", limit(http.HandlerFunc(registerHandler)))
@@ -759,18 +1334,22 @@ func runHTTPServer() {
 	serveMux.HandleFunc(hostname+"/delete/", deleteFileHandler)
 	serveMux.HandleFunc(hostname+"/delete-account", deleteAccountHandler)
 	serveMux.HandleFunc(hostname+"/reset-password", resetPasswordHandler)
+	serveMux.HandleFunc(hostname+"/proxy-identities", proxyIdentitiesHandler)
+	serveMux.HandleFunc(hostname+"/proxy-identities/", proxyIdentitiesHandler)
 
 	// Used by Caddy
 	serveMux.HandleFunc(hostname+"/check-domain", checkDomainHandler)
 
 	// admin commands
 	serveMux.HandleFunc(hostname+"/admin/user/", adminUserHandler)
+	serveMux.HandleFunc(hostname+"/admin/proxy-host/forget", adminProxyHostHandler)
 
 	wrapped := handlers.CustomLoggingHandler(log.Writer(), serveMux, logFormatter)
 
 	// handle user files based on subdomain or custom domains
 	// also routes to proxy
 	serveMux.HandleFunc("proxy."+hostname+"/", proxyGemini)
+	serveMux.HandleFunc("proxy."+hostname+proxySessionPath, proxySessionHandler)
 	serveMux.HandleFunc("/", userFile)
 	srv := &http.Server{
 		ReadTimeout:  5 * time.Second,
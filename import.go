@@ -0,0 +1,507 @@
+// Converts Markdown and simple HTML, e.g. exports from Hugo or Jekyll,
+// into gemtext
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+func canImport(filename string) bool {
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".md", ".markdown", ".html", ".htm":
+		return true
+	}
+	return false
+}
+
+// Convert a file to gemtext, returning the name to save it under. Posts
+// with a date are named into the gemlog.
+func importToGemtext(filename string, content []byte) (string, []byte, error) {
+	var doc importedDoc
+	var err error
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".md", ".markdown":
+		doc = markdownToGemtext(string(content))
+	case ".html", ".htm":
+		doc, err = htmlToGemtext(content)
+		if err != nil {
+			return "", nil, err
+		}
+	default:
+		return "", nil, fmt.Errorf("Can only import Markdown and HTML files")
+	}
+	return importFileName(filename, doc.Title, doc.Date), []byte(doc.Text), nil
+}
+
+type importedDoc struct {
+	Text  string
+	Title string
+	Date  string // yyyy-mm-dd, if known
+}
+
+var datePrefix = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}`)
+
+func importFileName(filename string, title string, date string) string {
+	base := strings.TrimSuffix(path.Base(filename), path.Ext(filename))
+	// Jekyll puts the date in the name of posts
+	if date == "" {
+		date = datePrefix.FindString(base)
+	}
+	if date == "" {
+		return path.Join(path.Dir(filename), base+".gmi")
+	}
+	base = strings.TrimLeft(datePrefix.ReplaceAllString(base, ""), "-_")
+	// Hugo and Jekyll export a post as <slug>/index.html
+	if (base == "" || base == "index") && title != "" {
+		base = title
+	}
+	return path.Join(GemlogFolder, date+"-"+slugify(base)+".gmi")
+}
+
+func parseImportDate(s string) string {
+	s = strings.Trim(strings.TrimSpace(s), `"'`)
+	if len(s) < 10 {
+		return ""
+	}
+	if _, err := time.Parse("2006-01-02", s[:10]); err != nil {
+		return ""
+	}
+	return s[:10]
+}
+
+// Builds up gemtext block by block. Links can't be inline in gemtext, so
+// they are written on their own lines after the block they appear in.
+type gemtextWriter struct {
+	b     strings.Builder
+	para  []string
+	links []string
+	last  string // kind of the previous line, to group lists and quotes
+	h1    bool
+}
+
+// A link line, or "" for links that don't make sense outside the page
+func linkLine(url string, name string) string {
+	name = strings.Join(strings.Fields(name), " ")
+	if url == "" || strings.HasPrefix(url, "#") {
+		return ""
+	}
+	if name == "" || name == url {
+		return "=> " + url
+	}
+	return "=> " + url + " " + name
+}
+
+func (g *gemtextWriter) addLinks(links []string) {
+	for _, l := range links {
+		if l != "" {
+			g.links = append(g.links, l)
+		}
+	}
+}
+
+// Text to join into the current paragraph
+func (g *gemtextWriter) text(s string, links []string) {
+	if g.last != "p" {
+		g.endBlock()
+	}
+	if s != "" {
+		g.para = append(g.para, s)
+	}
+	g.addLinks(links)
+	g.last = "p"
+}
+
+// A line of the given kind. Consecutive lines of the same kind are kept in
+// one block.
+func (g *gemtextWriter) line(kind string, s string, links []string) {
+	if kind != g.last {
+		g.endBlock()
+	}
+	fmt.Fprintf(&g.b, "%s\n", s)
+	g.addLinks(links)
+	g.last = kind
+}
+
+// Ends the current line of the paragraph, keeping its links for the end
+func (g *gemtextWriter) lineBreak() {
+	if len(g.para) > 0 {
+		fmt.Fprintf(&g.b, "%s\n", strings.Join(g.para, " "))
+		g.para = nil
+	}
+}
+
+func (g *gemtextWriter) heading(level int, s string, links []string) {
+	if level > 3 {
+		level = 3
+	}
+	if level == 1 {
+		g.h1 = true
+	}
+	g.endBlock()
+	g.line("h", strings.Repeat("#", level)+" "+s, links)
+	g.endBlock()
+}
+
+func (g *gemtextWriter) endBlock() {
+	written := g.last != ""
+	if len(g.para) > 0 {
+		fmt.Fprintf(&g.b, "%s\n", strings.Join(g.para, " "))
+		g.para = nil
+	}
+	for _, l := range g.links {
+		fmt.Fprintf(&g.b, "%s\n", l)
+		written = true
+	}
+	g.links = nil
+	if written {
+		g.b.WriteString("\n")
+	}
+	g.last = ""
+}
+
+// The finished gemtext, with a title heading if the source didn't have one
+func (g *gemtextWriter) finish(title string) string {
+	g.endBlock()
+	text := strings.TrimRight(g.b.String(), "\n") + "\n"
+	if !g.h1 && title != "" {
+		text = "# " + title + "\n\n" + text
+	}
+	return text
+}
+
+var (
+	mdHeading   = regexp.MustCompile(`^(#{1,6})\s+(.*?)[\s#]*$`)
+	mdListItem  = regexp.MustCompile(`^\s*(?:[-*+]|\d+[.)])\s+(.*)$`)
+	mdQuote     = regexp.MustCompile(`^\s*>\s?(.*)$`)
+	mdRule      = regexp.MustCompile(`^\s*(?:(?:\*\s*){3,}|(?:-\s*){3,}|(?:_\s*){3,})$`)
+	mdUnderline = regexp.MustCompile(`^\s*(=+|-+)\s*$`)
+	mdFence     = regexp.MustCompile("^\\s*(```|~~~)\\s*(.*)$")
+	mdRefDef    = regexp.MustCompile(`^\s{0,3}\[([^\]]+)\]:\s*<?([^\s>]+)>?`)
+	mdImage     = regexp.MustCompile(`!\[([^\]]*)\]\(\s*<?([^\s)>]+)>?(?:\s+"[^"]*")?\s*\)`)
+	mdLink      = regexp.MustCompile(`\[([^\]]+)\]\(\s*<?([^\s)>]+)>?(?:\s+"[^"]*")?\s*\)`)
+	mdRefLink   = regexp.MustCompile(`\[([^\]]+)\]\[([^\]]*)\]`)
+	mdAutoLink  = regexp.MustCompile(`<((?:https?|gemini|mailto):[^>\s]+)>`)
+)
+
+// Takes the links out of a line of Markdown, replacing them with their text
+func hoistMarkdownLinks(s string, refs map[string]string) (string, []string) {
+	var links []string
+	s = mdImage.ReplaceAllStringFunc(s, func(m string) string {
+		sub := mdImage.FindStringSubmatch(m)
+		name := sub[1]
+		if name == "" {
+			name = "Image"
+		}
+		links = append(links, linkLine(sub[2], name))
+		return ""
+	})
+	s = mdLink.ReplaceAllStringFunc(s, func(m string) string {
+		sub := mdLink.FindStringSubmatch(m)
+		links = append(links, linkLine(sub[2], sub[1]))
+		return sub[1]
+	})
+	s = mdRefLink.ReplaceAllStringFunc(s, func(m string) string {
+		sub := mdRefLink.FindStringSubmatch(m)
+		ref := sub[2]
+		if ref == "" {
+			ref = sub[1]
+		}
+		if url, ok := refs[strings.ToLower(ref)]; ok {
+			links = append(links, linkLine(url, sub[1]))
+		}
+		return sub[1]
+	})
+	s = mdAutoLink.ReplaceAllStringFunc(s, func(m string) string {
+		url := m[1 : len(m)-1]
+		links = append(links, linkLine(url, ""))
+		return url
+	})
+	return strings.TrimSpace(s), links
+}
+
+// Reads YAML or TOML front matter, returning the rest of the document
+func parseFrontMatter(lines []string) (map[string]string, []string) {
+	meta := map[string]string{}
+	if len(lines) == 0 || (lines[0] != "---" && lines[0] != "+++") {
+		return meta, lines
+	}
+	for i, l := range lines[1:] {
+		if l == lines[0] {
+			return meta, lines[i+2:]
+		}
+		sep := strings.IndexAny(l, ":=")
+		if sep > 0 {
+			key := strings.ToLower(strings.TrimSpace(l[:sep]))
+			meta[key] = strings.Trim(strings.TrimSpace(l[sep+1:]), `"'`)
+		}
+	}
+	// Not closed, so it wasn't front matter
+	return map[string]string{}, lines
+}
+
+func markdownToGemtext(md string) importedDoc {
+	lines := strings.Split(strings.ReplaceAll(md, "\r\n", "\n"), "\n")
+	meta, lines := parseFrontMatter(lines)
+	refs := map[string]string{}
+	for _, l := range lines {
+		if m := mdRefDef.FindStringSubmatch(l); m != nil {
+			refs[strings.ToLower(m[1])] = m[2]
+		}
+	}
+	var g gemtextWriter
+	var fence string
+	for _, l := range lines {
+		if fence != "" {
+			if strings.HasPrefix(strings.TrimSpace(l), fence) {
+				g.line("pre", "```", nil)
+				g.endBlock()
+				fence = ""
+			} else {
+				g.line("pre", l, nil)
+			}
+			continue
+		}
+		if m := mdFence.FindStringSubmatch(l); m != nil {
+			g.endBlock()
+			fence = m[1]
+			g.line("pre", "```"+m[2], nil)
+			continue
+		}
+		if strings.TrimSpace(l) == "" || mdRefDef.MatchString(l) {
+			g.endBlock()
+			continue
+		}
+		// Setext heading, the underline follows the text
+		if m := mdUnderline.FindStringSubmatch(l); m != nil && g.last == "p" && len(g.para) > 0 {
+			text := strings.Join(g.para, " ")
+			links := g.links
+			g.para, g.links = nil, nil
+			level := 1
+			if m[1][0] == '-' {
+				level = 2
+			}
+			g.heading(level, text, links)
+			continue
+		}
+		if mdRule.MatchString(l) {
+			g.endBlock()
+			continue
+		}
+		if m := mdHeading.FindStringSubmatch(l); m != nil {
+			text, links := hoistMarkdownLinks(m[2], refs)
+			g.heading(len(m[1]), text, links)
+			continue
+		}
+		if m := mdListItem.FindStringSubmatch(l); m != nil {
+			text, links := hoistMarkdownLinks(m[1], refs)
+			g.line("li", "* "+text, links)
+			continue
+		}
+		if m := mdQuote.FindStringSubmatch(l); m != nil {
+			text, links := hoistMarkdownLinks(m[1], refs)
+			if text != "" {
+				g.line("quote", "> "+text, links)
+			} else {
+				g.addLinks(links)
+			}
+			continue
+		}
+		text, links := hoistMarkdownLinks(l, refs)
+		g.text(text, links)
+	}
+	if fence != "" {
+		g.line("pre", "```", nil)
+	}
+	date := parseImportDate(meta["date"])
+	return importedDoc{g.finish(meta["title"]), meta["title"], date}
+}
+
+func htmlAttr(el xml.StartElement, name string) string {
+	for _, a := range el.Attr {
+		if strings.ToLower(a.Name.Local) == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// Elements that are page chrome rather than content
+var htmlSkipped = map[string]bool{
+	"script": true, "style": true, "noscript": true, "nav": true, "footer": true, "aside": true,
+}
+
+// Scripts and styles aren't valid XML, so they're removed before parsing
+var htmlScript = regexp.MustCompile(`(?is)<(script|style)\b.*?</(script|style)\s*>`)
+
+// Converts the simple parts of HTML. Page chrome like navigation and
+// scripts is dropped.
+func htmlToGemtext(content []byte) (importedDoc, error) {
+	content = htmlScript.ReplaceAll(content, nil)
+	d := xml.NewDecoder(bytes.NewReader(content))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	var g gemtextWriter
+	var doc importedDoc
+	var text strings.Builder
+	var links []string
+	var skip, quote, list, headingLevel int
+	var pre, inTitle bool
+	var linkHref string
+	var linkStart int
+	// Write out the text and links collected so far
+	flush := func() {
+		s := strings.Join(strings.Fields(text.String()), " ")
+		text.Reset()
+		if s == "" {
+			g.addLinks(links)
+		} else if headingLevel > 0 {
+			g.heading(headingLevel, s, links)
+		} else if list > 0 {
+			g.line("li", "* "+s, links)
+		} else if quote > 0 {
+			g.line("quote", "> "+s, links)
+		} else {
+			g.text(s, links)
+		}
+		links = nil
+	}
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return doc, err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(tok.Name.Local)
+			if htmlSkipped[name] {
+				skip++
+			}
+			if skip > 0 {
+				continue
+			}
+			switch name {
+			case "title":
+				inTitle = true
+			case "meta":
+				prop := htmlAttr(tok, "name") + htmlAttr(tok, "property")
+				if prop == "date" || prop == "article:published_time" {
+					doc.Date = parseImportDate(htmlAttr(tok, "content"))
+				}
+			case "time":
+				if doc.Date == "" {
+					doc.Date = parseImportDate(htmlAttr(tok, "datetime"))
+				}
+			case "h1", "h2", "h3", "h4", "h5", "h6":
+				flush()
+				headingLevel = int(name[1] - '0')
+			case "br":
+				if !pre {
+					flush()
+					g.lineBreak()
+				}
+			case "li":
+				if !pre {
+					flush()
+				}
+			case "p", "div", "section", "article", "main", "header", "table", "tr", "hr":
+				if !pre {
+					flush()
+					g.endBlock()
+				}
+			case "ul", "ol":
+				flush()
+				list++
+			case "blockquote":
+				flush()
+				g.endBlock()
+				quote++
+			case "pre":
+				flush()
+				g.endBlock()
+				pre = true
+				g.line("pre", "```", nil)
+			case "a":
+				linkHref = htmlAttr(tok, "href")
+				linkStart = text.Len()
+			case "img":
+				alt := htmlAttr(tok, "alt")
+				if alt == "" {
+					alt = "Image"
+				}
+				links = append(links, linkLine(htmlAttr(tok, "src"), alt))
+			}
+		case xml.EndElement:
+			name := strings.ToLower(tok.Name.Local)
+			if htmlSkipped[name] && skip > 0 {
+				skip--
+				continue
+			}
+			if skip > 0 {
+				continue
+			}
+			switch name {
+			case "title":
+				inTitle = false
+			case "h1", "h2", "h3", "h4", "h5", "h6":
+				flush()
+				headingLevel = 0
+			case "p", "div", "section", "article", "main", "header", "table", "tr", "li":
+				if !pre {
+					flush()
+				}
+			case "ul", "ol":
+				flush()
+				if list > 0 {
+					list--
+				}
+			case "blockquote":
+				flush()
+				g.endBlock()
+				if quote > 0 {
+					quote--
+				}
+			case "pre":
+				if pre {
+					// Keep the lines of preformatted text as they are
+					for _, l := range strings.Split(strings.Trim(text.String(), "\n"), "\n") {
+						g.line("pre", l, nil)
+					}
+					text.Reset()
+					g.line("pre", "```", nil)
+					g.endBlock()
+					g.addLinks(links)
+					links = nil
+					pre = false
+				}
+			case "a":
+				if linkStart <= text.Len() {
+					links = append(links, linkLine(linkHref, text.String()[linkStart:]))
+				}
+				linkHref = ""
+			}
+		case xml.CharData:
+			if skip > 0 {
+				continue
+			}
+			if inTitle {
+				doc.Title += string(tok)
+				continue
+			}
+			text.Write(tok)
+		}
+	}
+	flush()
+	doc.Title = strings.Join(strings.Fields(doc.Title), " ")
+	doc.Text = g.finish(doc.Title)
+	return doc, nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestImportFileName(t *testing.T) {
+	for _, tc := range []struct{ file, title, date, want string }{
+		{"about.md", "", "", "about.gmi"},
+		{"_posts/2021-02-03-hello.md", "", "", "gemlog/2021-02-03-hello.gmi"},
+		{"hello.md", "Hello", "2021-02-04", "gemlog/2021-02-04-hello.gmi"},
+		{"posts/my-post/index.html", "My Post!", "2020-01-02", "gemlog/2020-01-02-my-post.gmi"},
+	} {
+		if got := importFileName(tc.file, tc.title, tc.date); got != tc.want {
+			t.Errorf("importFileName(%q) = %q, want %q", tc.file, got, tc.want)
+		}
+	}
+}
+
+func TestMarkdownToGemtext(t *testing.T) {
+	doc := markdownToGemtext("---\ntitle: Hello\ndate: 2021-03-05\n---\nSome [text](https://a.com)\nhere.\n\n#### Deep\n- [one](/one)\n- two\n")
+	want := "# Hello\n\nSome text here.\n=> https://a.com text\n\n### Deep\n\n* one\n* two\n=> /one one\n"
+	if doc.Text != want || doc.Date != "2021-03-05" {
+		t.Errorf("got %q (%s), want %q", doc.Text, doc.Date, want)
+	}
+}
@@ -0,0 +1,83 @@
+// Checks links in gemtext pages to pages on this instance against the
+// files, so it works without network access.
+package main
+
+import (
+	"net/url"
+	"os"
+	"path"
+
+	gmi "git.sr.ht/~adnano/go-gemini"
+)
+
+type BrokenLink struct {
+	Line   int // starting at 1
+	URL    string
+	Reason string
+}
+
+// The problem with a link to a page on this instance, or "" if it's fine or
+// points somewhere else
+func checkLocalLink(u *url.URL) string {
+	if u.Scheme != "gemini" && u.Scheme != "http" && u.Scheme != "https" {
+		return ""
+	}
+	username := userFromHost(u.Hostname())
+	if username == "" {
+		return ""
+	}
+	if _, err := getUserByName(username); err != nil {
+		return "there is no user " + username
+	}
+	name := cleanStorageName(u.Path)
+	if inHiddenFolder(name) {
+		return "files in " + HiddenFolder + " can't be seen by visitors"
+	}
+	fullPath := path.Join(getUserDirectory(username), name)
+	info, err := store.Stat(fullPath)
+	if os.IsNotExist(err) {
+		// Feeds of feed folders are generated
+		dir, base := path.Split(name)
+		if feedFiles[base] != "" {
+			if folder, _ := getFeedFolder(username, dir); folder != nil {
+				return ""
+			}
+		}
+		return "not found"
+	} else if err != nil {
+		return err.Error()
+	}
+	if info.IsDir() {
+		if _, err := store.Stat(path.Join(fullPath, "index.gmi")); err != nil {
+			// Folders are listed over HTTP, and feed folders have a page
+			return ""
+		}
+		name = path.Join(name, "index.gmi")
+	}
+	if !isPublished(username, name) {
+		return "not published yet"
+	}
+	return ""
+}
+
+// Links in a user's page to missing or unpublished pages on this instance.
+// Relative links are resolved against the page.
+func checkLinks(username string, name string, text gmi.Text) []BrokenLink {
+	base := &url.URL{Scheme: "gemini", Host: username + "." + c.Host, Path: "/" + cleanStorageName(name)}
+	var broken []BrokenLink
+	for i, line := range text {
+		l, ok := line.(gmi.LineLink)
+		if !ok {
+			continue
+		}
+		u, err := url.Parse(l.URL)
+		if err != nil {
+			broken = append(broken, BrokenLink{i + 1, l.URL, "not a valid URL"})
+			continue
+		}
+		if reason := checkLocalLink(base.ResolveReference(u)); reason != "" {
+			broken = append(broken, BrokenLink{i + 1, l.URL, reason})
+		}
+	}
+	return broken
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	gmi "git.sr.ht/~adnano/go-gemini"
+)
+
+func TestCheckLinks(t *testing.T) {
+	defer setupStorageTest(t)()
+	addTestUser(t, "alex", true)
+	writeUserFile("alex", "a.gmi", strings.NewReader("a"))
+	writeUserFile("alex", "folder/b.gmi", strings.NewReader("b"))
+	setFileState("alex", "draft.gmi", &FileState{Draft: true})
+	writeUserFile("alex", "draft.gmi", strings.NewReader("c"))
+	text, _ := gmi.ParseText(strings.NewReader(`# Links
+=> /a.gmi
+=> ../folder/b.gmi
+=> /folder/
+=> missing.gmi
+=> gemini://alex.flounder.online/draft.gmi
+=> //bob.flounder.online/
+=> /gemlog/atom.xml
+=> gemini://example.com/missing.gmi
+`))
+	var got []string
+	for _, l := range checkLinks("alex", "folder/index.gmi", text) {
+		got = append(got, fmt.Sprintf("%d %s", l.Line, l.Reason))
+	}
+	want := []string{"5 not found", "6 not published yet", "7 there is no user bob"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+}
@@ -3,13 +3,11 @@ package main
 import (
 	"flag"
 	"fmt"
-	// "github.com/go-co-op/gocron"
 	"github.com/gorilla/sessions"
 	"io"
 	"log"
 	"os"
 	"sync"
-	// "time"
 )
 
 var c Config // global var to hold static configuration
@@ -35,6 +33,7 @@ func main() {
 	mw := io.MultiWriter(os.Stdout, logFile)
 	log.SetOutput(mw)
 
+	initStorage()
 	initializeDB()
 
 	cookie := generateCookieKeyIfDNE()
@@ -49,7 +48,17 @@ func main() {
 
 	switch args[0] {
 	case "serve":
-		// s1.StartAsync()
+		go reconcileUsageWorker()
+		go publishWorker()
+		go brokenLinkWorker()
+		go subscriptionWorker()
+		if c.Webmentions {
+			log.Println("Starting webmention workers")
+			for i := 0; i < webmentionWorkers; i++ {
+				go webmentionWorker()
+				go webmentionSender()
+			}
+		}
 		wg := new(sync.WaitGroup)
 		wg.Add(3)
 		go func() {
@@ -0,0 +1,461 @@
+// Mentions: links from one user's pages to another's, found when pages are
+// saved, and webmentions from other sites. Authors can show them in a
+// "Linked from" section at the end of their pages.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	gmi "git.sr.ht/~adnano/go-gemini"
+)
+
+type Mention struct {
+	TargetName     string
+	SourceURL      string // for mentions from other sites
+	SourceUsername string // for links on this instance
+	SourceName     string
+	Title          string
+	CreatedAt      int64 // timestamp
+}
+
+// Link to the mentioning page. Pages here are linked without a scheme, so
+// the link works over both Gemini and HTTP.
+func (m Mention) URL() string {
+	if m.SourceURL != "" {
+		return m.SourceURL
+	}
+	return "//" + m.SourceUsername + "." + c.Host + "/" + m.SourceName
+}
+
+// The page a link on this instance points to
+func localLinkTarget(u *url.URL) (string, string) {
+	if u.Scheme != "gemini" && u.Scheme != "http" && u.Scheme != "https" {
+		return "", ""
+	}
+	username := userFromHost(u.Hostname())
+	if username == "" {
+		return "", ""
+	}
+	name := cleanStorageName(u.Path)
+	if name == "" || strings.HasSuffix(u.Path, "/") || path.Ext(name) == "" {
+		name = path.Join(name, "index.gmi")
+	}
+	if inHiddenFolder(name) {
+		return "", ""
+	}
+	return username, name
+}
+
+type pageLink struct {
+	Username string // for pages on this instance
+	Name     string
+	URL      string // for pages on other websites
+}
+
+// Links in a user's gemtext page to other users' pages, and to other
+// websites
+func pageLinks(username string, name string, content []byte) []pageLink {
+	base := &url.URL{Scheme: "gemini", Host: username + "." + strings.SplitN(c.Host, ":", 2)[0], Path: "/" + name}
+	text, err := gmi.ParseText(bytes.NewReader(content))
+	if err != nil {
+		return nil
+	}
+	seen := map[pageLink]bool{}
+	var links []pageLink
+	for _, line := range text {
+		l, ok := line.(gmi.LineLink)
+		if !ok {
+			continue
+		}
+		u, err := url.Parse(l.URL)
+		if err != nil {
+			continue
+		}
+		u = base.ResolveReference(u)
+		u.Fragment = ""
+		var link pageLink
+		if targetUser, targetName := localLinkTarget(u); targetUser != "" {
+			if targetUser == username {
+				continue
+			}
+			link = pageLink{Username: targetUser, Name: targetName}
+		} else if u.Scheme == "http" || u.Scheme == "https" {
+			link = pageLink{URL: u.String()}
+		} else {
+			continue
+		}
+		if !seen[link] {
+			seen[link] = true
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// Record the links in a page that was saved. Pages in hidden folders don't
+// mention anyone.
+func updateMentions(username string, name string, content []byte) error {
+	name = cleanStorageName(name)
+	_, err := DB.Exec("DELETE FROM mention WHERE source_username = ? AND source_name = ?", username, name)
+	if err != nil || !isGemini(name) || inHiddenFolder(name) {
+		return err
+	}
+	title := searchTitle(name, content)
+	var external []string
+	for _, link := range pageLinks(username, name, content) {
+		if link.URL != "" {
+			external = append(external, link.URL)
+			continue
+		}
+		_, err = DB.Exec(`INSERT OR IGNORE INTO mention (target_username, target_name, source_url, source_username, source_name, title)
+VALUES (?, ?, '', ?, ?, ?)`, link.Username, link.Name, username, name, title)
+		if err != nil {
+			return err
+		}
+	}
+	if c.Webmentions && len(external) > 0 {
+		queueWebmentions(username, name, external)
+	}
+	return nil
+}
+
+// Forget the links in a page, or every page in a folder
+func deleteMentions(username string, name string) error {
+	name = cleanStorageName(name)
+	_, err := DB.Exec(`DELETE FROM mention WHERE source_username = ? AND (source_name = ? OR substr(source_name, 1, ?) = ?)`,
+		username, name, len(name)+1, name+"/")
+	return err
+}
+
+func renameMentions(username string, oldName string, newName string) error {
+	oldName, newName = cleanStorageName(oldName), cleanStorageName(newName)
+	_, err := DB.Exec(`UPDATE OR IGNORE mention SET source_name = ? || substr(source_name, ?) WHERE source_username = ? AND (source_name = ? OR substr(source_name, 1, ?) = ?)`,
+		newName, len(oldName)+1, username, oldName, len(oldName)+1, oldName+"/")
+	return err
+}
+
+const mentionColumns = "target_name, source_url, source_username, source_name, title, mention.created_at"
+
+func scanMentions(rows interface {
+	Next() bool
+	Scan(...interface{}) error
+	Err() error
+}) ([]Mention, error) {
+	mentions := []Mention{}
+	for rows.Next() {
+		var m Mention
+		err := rows.Scan(&m.TargetName, &m.SourceURL, &m.SourceUsername, &m.SourceName, &m.Title, &m.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		mentions = append(mentions, m)
+	}
+	return mentions, rows.Err()
+}
+
+// Pages linking to one of a user's pages. Links from users who have been
+// deactivated aren't shown.
+func getMentions(username string, name string) ([]Mention, error) {
+	rows, err := DB.Query(`SELECT `+mentionColumns+` FROM mention LEFT JOIN user ON user.username = source_username
+  WHERE target_username = ? AND target_name = ? AND (source_url != '' OR user.active)
+  ORDER BY mention.created_at DESC`, username, cleanStorageName(name))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanMentions(rows)
+}
+
+// The latest mentions of any of a user's pages
+func getRecentMentions(username string, limit int) ([]Mention, error) {
+	rows, err := DB.Query(`SELECT `+mentionColumns+` FROM mention LEFT JOIN user ON user.username = source_username
+  WHERE target_username = ? AND (source_url != '' OR user.active)
+  ORDER BY mention.created_at DESC LIMIT ?`, username, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanMentions(rows)
+}
+
+// The "Linked from" section for the end of a page
+func mentionLines(mentions []Mention) gmi.Text {
+	text := gmi.Text{gmi.LineText(""), gmi.LineHeading2("Linked from")}
+	for _, m := range mentions {
+		name := m.Title
+		if m.SourceUsername != "" {
+			name = m.SourceUsername + ": " + m.Title
+		}
+		text = append(text, gmi.LineLink{URL: m.URL(), Name: name})
+	}
+	return text
+}
+
+// The web address of a user's page, as sent in webmentions
+func pageWebURL(username string, name string) string {
+	if path.Base(name) == "index.gmi" {
+		name = strings.TrimSuffix(name, "index.gmi")
+	}
+	return "https://" + username + "." + c.Host + "/" + name
+}
+
+// Webmention endpoints in a Link header or in the page, per
+// https://www.w3.org/TR/webmention/#sender-discovers-receiver-webmention-endpoint
+var linkHeaderEndpoint = regexp.MustCompile(`<([^>]*)>\s*;[^,]*rel\s*=\s*"?[^",]*\bwebmention\b`)
+var linkElement = regexp.MustCompile(`(?is)<(?:link|a)\s[^>]*>`)
+var relWebmention = regexp.MustCompile(`(?i)\srel\s*=\s*("[^"]*\bwebmention\b[^"]*"|'[^']*\bwebmention\b[^']*'|webmention\b)`)
+var hrefAttr = regexp.MustCompile(`(?i)\shref\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)`)
+
+func findWebmentionEndpoint(header http.Header, body []byte, base *url.URL) *url.URL {
+	var endpoint string
+	found := false
+	for _, link := range header["Link"] {
+		if m := linkHeaderEndpoint.FindStringSubmatch(link); m != nil {
+			endpoint, found = m[1], true
+			break
+		}
+	}
+	if !found {
+		for _, element := range linkElement.FindAll(body, -1) {
+			if !relWebmention.Match(element) {
+				continue
+			}
+			if m := hrefAttr.FindSubmatch(element); m != nil {
+				endpoint, found = strings.Trim(string(m[1]), `"'`), true
+				break
+			}
+		}
+	}
+	if !found {
+		return nil
+	}
+	u, err := url.Parse(strings.Replace(endpoint, "&amp;", "&", -1))
+	if err != nil {
+		return nil
+	}
+	return base.ResolveReference(u)
+}
+
+type mentioningPage struct {
+	username string
+	name     string
+}
+
+// Pages waiting to send webmentions, and the links in each. A page saved
+// again before it's sent is only queued once, with its latest links.
+var sendWebmentionQueue = make(chan mentioningPage, 100)
+var pendingWebmentions = make(map[mentioningPage][]string)
+var pendingWebmentionsMu sync.Mutex
+
+// Queue webmentions from a page to be sent in the background. They're
+// skipped if the queue is full, and sent the next time the page is saved.
+func queueWebmentions(username string, name string, targets []string) {
+	pendingWebmentionsMu.Lock()
+	defer pendingWebmentionsMu.Unlock()
+	page := mentioningPage{username, name}
+	if _, ok := pendingWebmentions[page]; ok {
+		pendingWebmentions[page] = targets
+		return
+	}
+	select {
+	case sendWebmentionQueue <- page:
+		pendingWebmentions[page] = targets
+	default:
+		log.Printf("Too many webmentions waiting to be sent, skipping %s/%s", username, name)
+	}
+}
+
+// Sends queued webmentions. A few of these run at once.
+func webmentionSender() {
+	for page := range sendWebmentionQueue {
+		pendingWebmentionsMu.Lock()
+		targets := pendingWebmentions[page]
+		delete(pendingWebmentions, page)
+		pendingWebmentionsMu.Unlock()
+		sendWebmentions(page.username, page.name, targets)
+	}
+}
+
+// Send webmentions for links that haven't had one from this page yet
+func sendWebmentions(username string, name string, targets []string) {
+	source := pageWebURL(username, name)
+	client := guardedHTTPClient()
+	for _, target := range targets {
+		res, err := DB.Exec("INSERT OR IGNORE INTO webmention_sent (source_username, source_name, target_url) VALUES (?, ?, ?)",
+			username, name, target)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		err = sendWebmention(client, source, target)
+		if err != nil {
+			log.Printf("Webmention from %s to %s: %v", source, target, err)
+		}
+	}
+}
+
+func sendWebmention(client *http.Client, source string, target string) error {
+	resp, err := client.Get(target)
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1000000))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	endpoint := findWebmentionEndpoint(resp.Header, body, resp.Request.URL)
+	if endpoint == nil {
+		return nil
+	}
+	resp, err = client.PostForm(endpoint.String(), url.Values{"source": {source}, "target": {target}})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+var htmlTitle = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+type receivedWebmention struct {
+	source    *url.URL
+	targetURL string
+	username  string
+	name      string
+}
+
+// Webmentions waiting to be checked. Senders are turned away when it's full.
+var webmentionQueue = make(chan receivedWebmention, 100)
+
+// How many webmentions are checked, and sent, at once
+const webmentionWorkers = 4
+
+// Checks queued webmentions. A few of these run at once.
+func webmentionWorker() {
+	for m := range webmentionQueue {
+		verifyWebmention(m.source, m.targetURL, m.username, m.name)
+	}
+}
+
+// Fetch the source of a webmention and record it if it links to the target
+func verifyWebmention(source *url.URL, targetURL string, username string, name string) {
+	resp, err := guardedHTTPClient().Get(source.String())
+	if err != nil {
+		log.Printf("Webmention from %s: %v", source, err)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, c.ProxyMaxBytes))
+	if err != nil {
+		log.Printf("Webmention from %s: %v", source, err)
+		return
+	}
+	if resp.StatusCode == http.StatusGone || (resp.StatusCode == http.StatusOK && !bytes.Contains(body, []byte(targetURL))) {
+		// Deleted, or no longer links here
+		_, err = DB.Exec("DELETE FROM mention WHERE target_username = ? AND target_name = ? AND source_url = ?", username, name, source.String())
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	} else if resp.StatusCode != http.StatusOK {
+		return
+	}
+	title := source.String()
+	if m := htmlTitle.FindSubmatch(body); m != nil {
+		if t := strings.Join(strings.Fields(string(m[1])), " "); t != "" && len(t) < 200 {
+			title = t
+		}
+	}
+	_, err = DB.Exec(`INSERT INTO mention (target_username, target_name, source_url, source_username, source_name, title, created_at)
+VALUES (?, ?, ?, '', '', ?, ?)
+ON CONFLICT(target_username, target_name, source_url, source_username, source_name) DO UPDATE SET title = excluded.title`,
+		username, name, source.String(), title, time.Now().Unix())
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// Receives webmentions for users' pages. They're checked in the background.
+func webmentionHandler(w http.ResponseWriter, r *http.Request) {
+	if !c.Webmentions {
+		renderDefaultError(w, http.StatusNotFound)
+		return
+	}
+	if r.Method != "POST" {
+		renderError(w, "Send webmentions here with a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+	r.ParseForm()
+	source, err := url.Parse(r.Form.Get("source"))
+	if err != nil || (source.Scheme != "http" && source.Scheme != "https") || source.Host == "" {
+		renderError(w, "Invalid source", http.StatusBadRequest)
+		return
+	}
+	targetURL := r.Form.Get("target")
+	target, err := url.Parse(targetURL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") {
+		renderError(w, "Invalid target", http.StatusBadRequest)
+		return
+	}
+	username, name := localLinkTarget(target)
+	if username == "" || source.String() == target.String() {
+		renderError(w, "Target is not a page here", http.StatusBadRequest)
+		return
+	}
+	if _, err := store.Stat(path.Join(getUserDirectory(username), name)); err != nil {
+		renderError(w, "Target is not a page here", http.StatusBadRequest)
+		return
+	}
+	if userFromHost(source.Hostname()) != "" {
+		// Links between pages here are found when they're saved
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	select {
+	case webmentionQueue <- receivedWebmention{source, targetURL, username, name}:
+	default:
+		w.Header().Set("Retry-After", "60")
+		renderError(w, "Too many webmentions are waiting to be checked, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "Accepted, the source will be checked shortly")
+}
+
+// Add the "Linked from" section to a user's page if they want it. The
+// page's modification time becomes that of the latest mention, if later.
+func appendMentions(owner *User, name string, text gmi.Text, modTime time.Time) (gmi.Text, time.Time) {
+	if owner == nil || !owner.ShowMentions {
+		return text, modTime
+	}
+	mentions, err := getMentions(owner.Username, name)
+	if err != nil {
+		log.Println(err)
+		return text, modTime
+	}
+	if len(mentions) == 0 {
+		return text, modTime
+	}
+	if latest := time.Unix(mentions[0].CreatedAt, 0); latest.After(modTime) {
+		modTime = latest
+	}
+	return append(text, mentionLines(mentions)...), modTime
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMentions(t *testing.T) {
+	defer setupStorageTest(t)()
+	addTestUser(t, "alex", true)
+	addTestUser(t, "bob", true)
+	writeUserFile("bob", "a.gmi", strings.NewReader("# Hi\n=> gemini://alex.flounder.online/x.gmi\n=> //alex.flounder.online/\n=> b.gmi"))
+	sources := func(name string) []string {
+		t.Helper()
+		mentions, err := getMentions("alex", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result []string
+		for _, m := range mentions {
+			result = append(result, m.URL()+" "+m.Title)
+		}
+		return result
+	}
+	if got, want := sources("x.gmi"), []string{"//bob.flounder.online/a.gmi Hi"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+	if got := sources("index.gmi"); len(got) != 1 {
+		t.Errorf("Link to the site should mention index.gmi, got %v", got)
+	}
+	if got := sources("b.gmi"); len(got) != 0 {
+		t.Errorf("Links on the same site aren't mentions, got %v", got)
+	}
+	renameUserFile("bob", "a.gmi", "c.gmi")
+	if got, want := sources("x.gmi"), []string{"//bob.flounder.online/c.gmi Hi"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+	writeUserFile("bob", "c.gmi", strings.NewReader("# No links"))
+	if got := sources("x.gmi"); len(got) != 0 {
+		t.Errorf("Removed link is still a mention: %v", got)
+	}
+	writeUserFile("bob", "d.gmi", strings.NewReader("=> gemini://alex.flounder.online/x.gmi"))
+	deleteUserFile("bob", "d.gmi")
+	if got := sources("x.gmi"); len(got) != 0 {
+		t.Errorf("Deleted page is still a mention: %v", got)
+	}
+}
+
+func TestFindWebmentionEndpoint(t *testing.T) {
+	base, _ := url.Parse("https://example.com/post/1")
+	for _, test := range []struct {
+		header http.Header
+		body   string
+		want   string
+	}{
+		{http.Header{"Link": {`<https://webmention.example/a>; rel="webmention"`}}, "", "https://webmention.example/a"},
+		{http.Header{"Link": {`</wm>; rel="other webmention"`}}, "", "https://example.com/wm"},
+		{nil, `<link href="/wm?a=1&amp;b=2" rel="webmention">`, "https://example.com/wm?a=1&b=2"},
+		{nil, `<a rel=webmention href='wm'>`, "https://example.com/post/wm"},
+		{nil, `<link rel="webmention" href="">`, "https://example.com/post/1"},
+		{nil, `<link rel="stylesheet" href="style.css">`, ""},
+	} {
+		got := ""
+		if u := findWebmentionEndpoint(test.header, []byte(test.body), base); u != nil {
+			got = u.String()
+		}
+		if got != test.want {
+			t.Errorf("Got %q for %v %q, want %q", got, test.header, test.body, test.want)
+		}
+	}
+}
+
+func TestWebmentionQueue(t *testing.T) {
+	defer setupStorageTest(t)()
+	defer setupErrorTemplate()()
+	c.Webmentions = true
+	addTestUser(t, "alex", true)
+	writeUserFile("alex", "x.gmi", strings.NewReader("# X"))
+	send := func() int {
+		form := url.Values{"source": {"https://example.com/post"}, "target": {"https://alex.flounder.online/x.gmi"}}
+		req := httptest.NewRequest("POST", "/webmention", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		webmentionHandler(w, req)
+		return w.Code
+	}
+	// No workers are running, so the queue fills up
+	for i := 0; i < cap(webmentionQueue); i++ {
+		if code := send(); code != http.StatusAccepted {
+			t.Fatalf("Got %d, want %d", code, http.StatusAccepted)
+		}
+	}
+	if code := send(); code != http.StatusServiceUnavailable {
+		t.Errorf("Got %d with a full queue, want %d", code, http.StatusServiceUnavailable)
+	}
+	for len(webmentionQueue) > 0 {
+		<-webmentionQueue
+	}
+}
+
+func TestWebmentionSendQueue(t *testing.T) {
+	defer func() {
+		for len(sendWebmentionQueue) > 0 {
+			delete(pendingWebmentions, <-sendWebmentionQueue)
+		}
+	}()
+	// No senders are running, so saves of the same page pile up
+	queueWebmentions("alex", "a.gmi", []string{"https://example.com/1"})
+	queueWebmentions("alex", "a.gmi", []string{"https://example.com/2"})
+	queueWebmentions("alex", "b.gmi", []string{"https://example.com/3"})
+	if len(sendWebmentionQueue) != 2 {
+		t.Errorf("Queued %d pages, want 2", len(sendWebmentionQueue))
+	}
+	if got := pendingWebmentions[mentioningPage{"alex", "a.gmi"}]; len(got) != 1 || got[0] != "https://example.com/2" {
+		t.Errorf("Page is waiting to send to %v, want its latest links", got)
+	}
+	for i := len(sendWebmentionQueue); i < cap(sendWebmentionQueue); i++ {
+		queueWebmentions("alex", fmt.Sprintf("%d.gmi", i), []string{"https://example.com/"})
+	}
+	queueWebmentions("alex", "full.gmi", []string{"https://example.com/"})
+	if _, ok := pendingWebmentions[mentioningPage{"alex", "full.gmi"}]; ok {
+		t.Errorf("Page was added to a full queue")
+	}
+}
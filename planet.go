@@ -0,0 +1,107 @@
+// The planet: recent gemlog posts from everyone who hasn't opted out, on
+// one page and in one feed. Entries are cached in the planet_entry table,
+// which is kept current along with the file index.
+package main
+
+import (
+	"net/url"
+	"strings"
+	"time"
+)
+
+func inGemlog(name string) bool {
+	name = cleanStorageName(name)
+	return name == GemlogFolder || strings.HasPrefix(name, GemlogFolder+"/")
+}
+
+// Replace a user's cached entries with what's in their gemlog now
+func refreshPlanetEntries(username string) error {
+	feed := generateFeedFromUser(username)
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM planet_entry WHERE username = ?", username)
+	if feed != nil {
+		for _, e := range feed.Entries {
+			if err != nil {
+				break
+			}
+			_, err = tx.Exec(`INSERT OR IGNORE INTO planet_entry (username, url, title, date, updated_at, content)
+VALUES (?, ?, ?, ?, ?, ?)`, username, e.Url.String(), e.Title, e.DateString, e.Updated.Unix(), e.Content)
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Recent entries, newest first, a page at a time. Pages start at 1.
+func getPlanetEntries(page int) ([]FeedEntry, bool, error) {
+	if page < 1 {
+		page = 1
+	}
+	rows, err := DB.Query(`SELECT planet_entry.username, url, planet_entry.title, date, updated_at, planet_entry.content FROM planet_entry
+  JOIN user ON user.username = planet_entry.username
+  LEFT JOIN site_config ON site_config.username = planet_entry.username
+  WHERE user.active AND coalesce(site_config.listed, user.listed) AND user.in_planet
+  ORDER BY date DESC, updated_at DESC LIMIT ? OFFSET ?`, indexPageSize+1, (page-1)*indexPageSize)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	feeds := map[string]*Gemfeed{}
+	entries := []FeedEntry{}
+	for rows.Next() {
+		var e FeedEntry
+		var username, link string
+		var updated int64
+		err = rows.Scan(&username, &link, &e.Title, &e.DateString, &updated, &e.Content)
+		if err != nil {
+			return nil, false, err
+		}
+		e.Url, err = url.Parse(link)
+		if err != nil {
+			continue
+		}
+		e.Date, _ = time.Parse("2006-01-02", e.DateString)
+		e.Updated = time.Unix(updated, 0)
+		if feeds[username] == nil {
+			feeds[username] = &Gemfeed{Creator: username}
+		}
+		e.Feed = feeds[username]
+		entries = append(entries, e)
+	}
+	hasMore := len(entries) > indexPageSize
+	if hasMore {
+		entries = entries[:indexPageSize]
+	}
+	return entries, hasMore, rows.Err()
+}
+
+// The latest page of the planet as a feed
+func generatePlanetFeed() (*Gemfeed, error) {
+	entries, _, err := getPlanetEntries(1)
+	if err != nil {
+		return nil, err
+	}
+	feed := Gemfeed{
+		Title:    c.SiteTitle + " Planet",
+		Subtitle: "Recent gemlog posts on " + c.SiteTitle,
+		Url:      &url.URL{Host: c.Host, Path: "/planet"},
+		Entries:  entries,
+	}
+	sortFeed(&feed)
+	return &feed, nil
+}
+
+// Link to an entry over Gemini
+func (fe FeedEntry) GeminiURL() string {
+	u := *fe.Url
+	if u.Scheme == "" {
+		u.Scheme = "gemini"
+	}
+	return u.String()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPlanet(t *testing.T) {
+	defer setupStorageTest(t)()
+	addTestUser(t, "alex", true)
+	writeUserFile("alex", "gemlog/2021-01-02-a.gmi", strings.NewReader("# A"))
+	writeUserFile("alex", "gemlog/2021-02-03-b.gmi", strings.NewReader("# B"))
+	writeUserFile("alex", "notes.gmi", strings.NewReader("# Not a post"))
+	writeUserFile("alex", "gemlog/"+HiddenFolder+"/2021-03-04-c.gmi", strings.NewReader("# Hidden"))
+	titles := func() []string {
+		t.Helper()
+		entries, _, err := getPlanetEntries(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result []string
+		for _, e := range entries {
+			result = append(result, e.Feed.Creator+": "+e.Title)
+		}
+		return result
+	}
+	if got, want := titles(), []string{"alex: B", "alex: A"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+	deleteUserFile("alex", "gemlog/2021-02-03-b.gmi")
+	if got, want := titles(), []string{"alex: A"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got %v, want %v", got, want)
+	}
+	feed, err := generatePlanetFeed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	atom, _ := feed.render("atom", "https")
+	if !strings.Contains(atom, "<name>alex</name>") {
+		t.Errorf("Planet entries should have authors: %s", atom)
+	}
+	DB.Exec("UPDATE user SET in_planet = false WHERE username = 'alex'")
+	if got := titles(); len(got) != 0 {
+		t.Errorf("Opted out user's posts are shown: %v", got)
+	}
+}
@@ -2,21 +2,33 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"html/template"
-	"io"
+	"log"
 	"mime"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
-	"time"
 
 	"git.sr.ht/~adnano/go-gemini"
+	"golang.org/x/text/encoding/htmlindex"
 )
 
 func proxyGemini(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
+	if r.Method == "POST" {
+		// Answer to an input prompt, resubmit it as the gemini query
+		r.ParseForm()
+		next := url.URL{
+			Path:     r.URL.Path,
+			RawQuery: gemini.QueryEscape(r.Form.Get("q")),
+		}
+		http.Redirect(w, r, next.String(), http.StatusSeeOther)
+		return
+	} else if r.Method != "GET" {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		w.Write([]byte("404 Not found"))
 		return
@@ -40,27 +52,49 @@ func proxyGemini(w http.ResponseWriter, r *http.Request) {
 	} else {
 		req.URL, err = url.Parse(fmt.Sprintf("gemini://%s/", spath[1]))
 	}
-	req.URL.RawQuery = r.URL.RawQuery
-	client := gemini.Client{
-		Timeout: 60 * time.Second,
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Invalid URL: %v", err)
+		return
 	}
+	req.URL.RawQuery = r.URL.RawQuery
 
 	if h := (url.URL{Host: req.Host}); h.Port() == "" {
 		req.Host += ":1965"
 	}
 
-	resp, err := client.Do(&req)
+	_, raw := r.URL.Query()["raw"]
+	acceptsGemini := strings.Contains(r.Header.Get("Accept"), "text/gemini")
+	proxyUser := getProxyUser(r)
+	// Identities are only used for pages the proxy renders itself, never for
+	// responses passed through as they are
+	if proxyUser != "" && !raw && !acceptsGemini {
+		req.Certificate, err = getProxyCertificate(proxyUser, req.URL.Hostname())
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	resp, err := fetchGemini(&req)
 	if err != nil {
+		var mismatch *certMismatchError
+		if errors.As(err, &mismatch) {
+			renderProxyMessage(w, r, http.StatusBadGateway, req.URL, "Certificate changed", "proxy_cert_error.html", mismatch)
+			return
+		}
+		if perr, ok := err.(*proxyError); ok {
+			w.WriteHeader(perr.StatusCode)
+			fmt.Fprintf(w, "Proxy error: %s", perr.Msg)
+			return
+		}
 		w.WriteHeader(http.StatusBadGateway)
 		fmt.Fprintf(w, "Gateway error: %v", err)
 		return
 	}
-	defer resp.Body.Close()
 
 	switch resp.Status {
 	case 10, 11:
-		// TODO accept input
-		w.WriteHeader(http.StatusInternalServerError)
+		renderProxyInput(w, r, req.URL, resp.Meta, resp.Status == 11)
 		return
 	case 20:
 		break // OK
@@ -69,6 +103,7 @@ func proxyGemini(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			w.WriteHeader(http.StatusBadGateway)
 			w.Write([]byte(fmt.Sprintf("Gateway error: bad redirect %v", err)))
+			return
 		}
 		next := req.URL.ResolveReference(to)
 		if next.Scheme != "gemini" {
@@ -95,13 +130,23 @@ func proxyGemini(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		fmt.Fprintf(w, "The remote server returned %d: %s", resp.Status, resp.Meta)
 		return
+	case 60, 61, 62:
+		data := struct {
+			Status      int
+			Meta        string
+			URL         string
+			HasIdentity bool
+			Config      Config
+		}{resp.Status, resp.Meta, req.URL.String(), req.Certificate != nil, c}
+		renderProxyMessage(w, r, http.StatusForbidden, req.URL, "Certificate required", "proxy_cert_required.html", data)
+		return
 	default:
 		w.WriteHeader(http.StatusNotImplemented)
 		fmt.Fprintf(w, "Proxy does not understand Gemini response status %d", resp.Status)
 		return
 	}
 
-	m, _, err := mime.ParseMediaType(resp.Meta)
+	m, params, err := mime.ParseMediaType(resp.Meta)
 	if err != nil {
 		w.WriteHeader(http.StatusBadGateway)
 		w.Write([]byte(fmt.Sprintf("Gateway error: %d %s: %v",
@@ -109,27 +154,56 @@ func proxyGemini(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, raw := r.URL.Query()["raw"]
-	acceptsGemini := strings.Contains(r.Header.Get("Accept"), "text/gemini")
+	if m != "text/gemini" && req.Certificate != nil {
+		// Fetch it again without the identity
+		next := *r.URL
+		next.RawQuery = strings.TrimPrefix(next.RawQuery+"&raw=1", "&")
+		http.Redirect(w, r, next.String(), http.StatusSeeOther)
+		return
+	}
 	if m != "text/gemini" || raw || acceptsGemini {
-		w.Header().Add("Content-Type", resp.Meta)
-		io.Copy(w, resp.Body)
+		// Capsules can serve any content, which mustn't run scripts on the
+		// proxy's origin, where users are logged in
+		w.Header().Set("Content-Security-Policy", "sandbox")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		contentType := resp.Meta
+		if strings.HasPrefix(m, "text/") && params["charset"] == "" {
+			// Gemini text defaults to UTF-8, HTTP text doesn't
+			params["charset"] = "utf-8"
+			contentType = mime.FormatMediaType(m, params)
+		}
+		w.Header().Add("Content-Type", contentType)
+		w.Header().Add("Content-Length", strconv.Itoa(len(resp.Body)))
+		w.Write(resp.Body)
 		return
 	}
 
-	w.Header().Add("Content-Type", "text/html")
-	parse, _ := gemini.ParseText(resp.Body)
-	htmlDoc := textToHTML(req.URL, parse)
+	body, err := decodeCharset(resp.Body, params["charset"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, "Gateway error: %v", err)
+		return
+	}
+	w.Header().Add("Content-Type", "text/html; charset=utf-8")
+	parse, _ := gemini.ParseText(bytes.NewReader(body))
+	htmlDoc := textToHTML(req.URL, parse, wantsInlineMedia(proxyUser))
+	// lang may be a comma separated list, use the first
+	lang := strings.SplitN(params["lang"], ",", 2)[0]
 	if strings.HasSuffix(r.URL.Path, "/") {
 		r.URL.Path = path.Dir(r.URL.Path)
 	}
 	data := struct {
-		SiteBody  template.HTML
-		PageTitle string
-		GeminiURI *url.URL
-		URI       *url.URL
-		Config    Config
-	}{template.HTML(htmlDoc.Content), htmlDoc.Title, req.URL, r.URL, c}
+		SiteBody    template.HTML
+		PageTitle   string
+		Lang        string
+		GeminiURI   *url.URL
+		URI         *url.URL
+		Feeds       []FeedFolder
+		Webmentions bool
+		Theme       *SiteTheme
+		Site        *SiteConfig
+		Config      Config
+	}{template.HTML(htmlDoc.Content), htmlDoc.Title, lang, req.URL, r.URL, nil, false, nil, nil, c}
 
 	err = t.ExecuteTemplate(w, "user_page.html", data)
 	if err != nil {
@@ -138,3 +212,60 @@ func proxyGemini(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// Render a form for a gemini input prompt. Status 11 is sensitive input, so
+// the answer goes in a password field.
+func renderProxyInput(w http.ResponseWriter, r *http.Request, geminiURL *url.URL, prompt string, sensitive bool) {
+	form := struct {
+		Prompt    string
+		Action    string
+		Sensitive bool
+	}{prompt, r.URL.Path, sensitive}
+	// Don't keep the previous answer in the page URL
+	geminiURL.RawQuery = ""
+	renderProxyMessage(w, r, http.StatusOK, geminiURL, prompt, "proxy_input.html", form)
+}
+
+// Render a page generated by the proxy itself inside the usual page layout
+func renderProxyMessage(w http.ResponseWriter, r *http.Request, statusCode int, geminiURL *url.URL, title string, name string, data interface{}) {
+	var buff bytes.Buffer
+	err := t.ExecuteTemplate(&buff, name, data)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	uri := *r.URL
+	uri.RawQuery = ""
+	page := struct {
+		SiteBody    template.HTML
+		PageTitle   string
+		Lang        string
+		GeminiURI   *url.URL
+		URI         *url.URL
+		Feeds       []FeedFolder
+		Webmentions bool
+		Theme       *SiteTheme
+		Site        *SiteConfig
+		Config      Config
+	}{template.HTML(buff.String()), title, "", geminiURL, &uri, nil, false, nil, nil, c}
+	w.Header().Add("Content-Type", "text/html")
+	w.WriteHeader(statusCode)
+	err = t.ExecuteTemplate(w, "user_page.html", page)
+	if err != nil {
+		fmt.Fprintf(w, "%v", err)
+	}
+}
+
+// Convert a text body in the charset from the gemini meta to UTF-8
+func decodeCharset(body []byte, charset string) ([]byte, error) {
+	charset = strings.ToLower(charset)
+	if charset == "" || charset == "utf-8" || charset == "us-ascii" {
+		return body, nil
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %s", charset)
+	}
+	return enc.NewDecoder().Bytes(body)
+}
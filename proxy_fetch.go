@@ -0,0 +1,238 @@
+// Guards and caching for requests made by the Gemini proxy, so that
+// proxy.<host> can be run in public.
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"git.sr.ht/~adnano/go-gemini"
+)
+
+// A gemini response read fully into memory
+type proxyResponse struct {
+	Status int
+	Meta   string
+	Body   []byte
+}
+
+type proxyError struct {
+	StatusCode int // http status to return
+	Msg        string
+}
+
+func (e *proxyError) Error() string {
+	return e.Msg
+}
+
+// Fetch a gemini URL on behalf of a proxy user. Responses are served from
+// the cache when possible, unless the request carries a client certificate
+// or answers an input prompt.
+func fetchGemini(req *gemini.Request) (*proxyResponse, error) {
+	key := req.URL.String()
+	// Responses to requests with a client certificate are per user, and a
+	// query is a user's answer to a prompt, which may be private
+	cacheable := req.Certificate == nil && req.URL.RawQuery == ""
+	if resp := proxyCache.get(key); cacheable && resp != nil {
+		return resp, nil
+	}
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		return nil, err
+	}
+	if !c.ProxyAllowPrivate {
+		err = checkProxyDestination(host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	release, ok := acquireOrigin(host)
+	if !ok {
+		return nil, &proxyError{503, fmt.Sprintf("Too many requests to %s, try again later", host)}
+	}
+	defer release()
+	log.Printf("Proxy request to %s%s", req.URL.Host, req.URL.Path)
+
+	client := gemini.Client{
+		Timeout:          time.Duration(c.ProxyTimeout) * time.Second,
+		TrustCertificate: trustProxyCertificate,
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// Read one byte past the limit to detect oversized bodies
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, c.ProxyMaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > c.ProxyMaxBytes {
+		return nil, &proxyError{502, fmt.Sprintf("Response from %s is larger than the %d byte limit", host, c.ProxyMaxBytes)}
+	}
+	result := &proxyResponse{resp.Status, resp.Meta, body}
+	if cacheable && resp.Status == 20 {
+		proxyCache.put(key, result)
+	}
+	return result, nil
+}
+
+var disallowedNets []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"0.0.0.0/8",      // "this" network
+		"10.0.0.0/8",     // private
+		"100.64.0.0/10",  // carrier-grade NAT
+		"127.0.0.0/8",    // loopback
+		"169.254.0.0/16", // link-local
+		"172.16.0.0/12",  // private
+		"192.168.0.0/16", // private
+		"::/128",         // unspecified
+		"::1/128",        // loopback
+		"fc00::/7",       // unique local
+		"fe80::/10",      // link-local
+	} {
+		_, n, _ := net.ParseCIDR(cidr)
+		disallowedNets = append(disallowedNets, n)
+	}
+}
+
+func isDisallowedIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range disallowedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return ip.IsMulticast()
+}
+
+// An HTTP client for fetches made for users, e.g. of feeds, with the same
+// limits on destinations as the proxy
+func guardedHTTPClient() *http.Client {
+	client := &http.Client{Timeout: time.Duration(c.ProxyTimeout) * time.Second}
+	if !c.ProxyAllowPrivate {
+		// Check each address as it's dialed, redirects included
+		dialer := &net.Dialer{Timeout: time.Duration(c.ProxyTimeout) * time.Second}
+		client.Transport = &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				host, _, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				err = checkProxyDestination(host)
+				if err != nil {
+					return nil, err
+				}
+				return dialer.DialContext(ctx, network, addr)
+			},
+		}
+	}
+	return client
+}
+
+// Deny hosts that resolve to private, loopback or link-local addresses.
+// NOTE: the gemini client does its own lookup when dialing, so this doesn't
+// protect against DNS rebinding.
+func checkProxyDestination(host string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return &proxyError{502, fmt.Sprintf("Could not resolve %s", host)}
+	}
+	for _, addr := range addrs {
+		if isDisallowedIP(addr.IP) {
+			return &proxyError{403, fmt.Sprintf("The proxy is not allowed to connect to %s", host)}
+		}
+	}
+	return nil
+}
+
+// Count of in-flight requests to each origin host
+var proxyOrigins = make(map[string]int)
+var proxyOriginsMu sync.Mutex
+
+func acquireOrigin(host string) (func(), bool) {
+	proxyOriginsMu.Lock()
+	defer proxyOriginsMu.Unlock()
+	if proxyOrigins[host] >= c.ProxyMaxPerHost {
+		return nil, false
+	}
+	proxyOrigins[host]++
+	return func() {
+		proxyOriginsMu.Lock()
+		defer proxyOriginsMu.Unlock()
+		proxyOrigins[host]--
+		if proxyOrigins[host] <= 0 {
+			delete(proxyOrigins, host)
+		}
+	}, true
+}
+
+// In-memory LRU cache of successful responses
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List // front is most recently used
+}
+
+type cacheEntry struct {
+	key     string
+	resp    *proxyResponse
+	expires time.Time
+}
+
+var proxyCache = &responseCache{
+	entries: make(map[string]*list.Element),
+	order:   list.New(),
+}
+
+func (rc *responseCache) get(key string) *proxyResponse {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	el, ok := rc.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		rc.order.Remove(el)
+		delete(rc.entries, key)
+		return nil
+	}
+	rc.order.MoveToFront(el)
+	return entry.resp
+}
+
+func (rc *responseCache) put(key string, resp *proxyResponse) {
+	if c.ProxyCacheEntries <= 0 {
+		return
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	expires := time.Now().Add(time.Duration(c.ProxyCacheTTL) * time.Second)
+	if el, ok := rc.entries[key]; ok {
+		el.Value = &cacheEntry{key, resp, expires}
+		rc.order.MoveToFront(el)
+		return
+	}
+	rc.entries[key] = rc.order.PushFront(&cacheEntry{key, resp, expires})
+	for rc.order.Len() > c.ProxyCacheEntries {
+		oldest := rc.order.Back()
+		rc.order.Remove(oldest)
+		delete(rc.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
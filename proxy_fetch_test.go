@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"testing"
+
+	"git.sr.ht/~adnano/go-gemini"
+)
+
+func TestIsDisallowedIP(t *testing.T) {
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "192.168.0.1", "169.254.1.1", "::1", "fe80::1", "fd00::1", "::ffff:127.0.0.1"} {
+		if !isDisallowedIP(net.ParseIP(ip)) {
+			t.Errorf("IP " + ip + " should be denied to the proxy, but wasn't")
+		}
+	}
+	for _, ip := range []string{"1.1.1.1", "2001:4860:4860::8888"} {
+		if isDisallowedIP(net.ParseIP(ip)) {
+			t.Errorf("IP " + ip + " should be allowed to the proxy, but wasn't")
+		}
+	}
+}
+
+func TestProxyCacheSkipsInput(t *testing.T) {
+	oldConfig := c
+	defer func() { c = oldConfig }()
+	c.ProxyCacheEntries = 10
+	c.ProxyCacheTTL = 60
+	c.ProxyAllowPrivate = false
+	fetch := func(rawurl string) (*proxyResponse, error) {
+		u, _ := url.Parse(rawurl)
+		return fetchGemini(&gemini.Request{URL: u, Host: "127.0.0.1:1965"})
+	}
+	cached := &proxyResponse{20, "text/gemini", []byte("cached")}
+	proxyCache.put("gemini://127.0.0.1/", cached)
+	proxyCache.put("gemini://127.0.0.1/search?secret", cached)
+	// The proxy can't connect to 127.0.0.1, so anything not served from
+	// the cache fails
+	if resp, err := fetch("gemini://127.0.0.1/"); err != nil || resp != cached {
+		t.Errorf("Got %v, %v, want the cached response", resp, err)
+	}
+	if resp, err := fetch("gemini://127.0.0.1/search?secret"); err == nil {
+		t.Errorf("Answer to an input prompt was served from the cache: %v", resp)
+	}
+}
@@ -0,0 +1,322 @@
+// Client certificate identities that the proxy presents to capsules on
+// behalf of logged in users
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.sr.ht/~adnano/go-gemini/certificate"
+	"github.com/gorilla/sessions"
+)
+
+// Paths on the proxy host used by flounder itself. Hostnames can't start
+// with a dot, so these never clash with proxied capsules.
+const proxySessionPath = "/.flounder/session"
+
+type ProxyIdentity struct {
+	ID          int
+	Hostname    string
+	Name        string
+	Fingerprint string
+	CreatedAt   int64 // timestamp
+}
+
+// Key used to encrypt identity private keys at rest, derived from the
+// SecretKey in the config so that a copy of the DB alone isn't enough.
+func identityKey() ([]byte, error) {
+	if c.SecretKey == "" {
+		return nil, fmt.Errorf("Client certificates are not enabled on this instance")
+	}
+	sum := sha256.Sum256([]byte("proxy-identity:" + c.SecretKey))
+	return sum[:], nil
+}
+
+func encryptIdentityKey(plaintext []byte) ([]byte, error) {
+	key, err := identityKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func decryptIdentityKey(ciphertext []byte) ([]byte, error) {
+	key, err := identityKey()
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, fmt.Errorf("Encrypted key is too short")
+	}
+	nonce := ciphertext[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, ciphertext[gcm.NonceSize():], nil)
+}
+
+func certFingerprint(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Generate a new client certificate for a capsule, replacing any existing one
+func createProxyIdentity(username string, hostname string, name string) error {
+	if name == "" {
+		name = username
+	}
+	cert, err := certificate.Create(certificate.CreateOptions{
+		Subject: pkix.Name{
+			CommonName: name,
+		},
+		Duration: time.Hour * 8760 * 5, // 5 years
+	})
+	if err != nil {
+		return err
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+	encryptedKey, err := encryptIdentityKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}))
+	if err != nil {
+		return err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Leaf.Raw})
+	_, err = DB.Exec(`INSERT OR REPLACE INTO proxy_identity (username, hostname, name, fingerprint, certificate, private_key)
+values (?, ?, ?, ?, ?, ?)`, username, hostname, name, certFingerprint(cert.Leaf.Raw), certPEM, encryptedKey)
+	if err != nil {
+		return err
+	}
+	log.Printf("User %s created a proxy identity for %s", username, hostname)
+	return nil
+}
+
+// Returns nil if the user has no identity for this host
+func getProxyCertificate(username string, hostname string) (*tls.Certificate, error) {
+	row := DB.QueryRow("SELECT certificate, private_key FROM proxy_identity WHERE username = ? AND hostname = ?", username, hostname)
+	var certPEM, encryptedKey []byte
+	err := row.Scan(&certPEM, &encryptedKey)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	keyPEM, err := decryptIdentityKey(encryptedKey)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+func getProxyIdentities(username string) ([]ProxyIdentity, error) {
+	rows, err := DB.Query("SELECT id, hostname, name, fingerprint, created_at FROM proxy_identity WHERE username = ? ORDER BY hostname", username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var identities []ProxyIdentity
+	for rows.Next() {
+		var id ProxyIdentity
+		err = rows.Scan(&id.ID, &id.Hostname, &id.Name, &id.Fingerprint, &id.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, id)
+	}
+	return identities, nil
+}
+
+func randomToken() (string, error) {
+	k := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, k)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(k), nil
+}
+
+// Single use token that carries a login from the main host over to the
+// proxy host, which has its own cookie. Only the proxy session accepts it.
+func createProxyLoginToken(username string) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	expires := time.Now().Add(5 * time.Minute).Unix()
+	_, err = DB.Exec("INSERT INTO proxy_login_token (token, username, expires) values (?, ?, ?)", token, username, expires)
+	return token, err
+}
+
+func consumeProxyLoginToken(token string) (string, error) {
+	row := DB.QueryRow("SELECT username, expires FROM proxy_login_token WHERE token = ?", token)
+	var username string
+	var expires int64
+	err := row.Scan(&username, &expires)
+	if err != nil {
+		return "", fmt.Errorf("Invalid login token")
+	}
+	_, err = DB.Exec("DELETE FROM proxy_login_token WHERE token = ? OR expires < ?", token, time.Now().Unix())
+	if err != nil {
+		return "", err
+	}
+	if time.Now().Unix() > expires {
+		return "", fmt.Errorf("Login token expired")
+	}
+	return username, nil
+}
+
+// User logged in to the proxy host, if any
+func getProxyUser(r *http.Request) string {
+	session, _ := SessionStore.Get(r, "proxy-session")
+	user, _ := session.Values["auth_user"].(string)
+	if user == "" {
+		return ""
+	}
+	// The session outlives a deleted or renamed user
+	var exists bool
+	row := DB.QueryRow("SELECT 1 FROM user WHERE username = ?", user)
+	if row.Scan(&exists) != nil {
+		return ""
+	}
+	return user
+}
+
+// Redirect to the proxy host, logging the user in there, then continue on
+// to next, a path on the proxy.
+func redirectToProxy(w http.ResponseWriter, r *http.Request, username string, next string) {
+	token, err := createProxyLoginToken(username)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	u := url.URL{
+		Host:     "proxy." + c.Host,
+		Path:     proxySessionPath,
+		RawQuery: url.Values{"token": {token}, "next": {next}}.Encode(),
+	}
+	// Scheme relative, so this works behind a TLS reverse proxy
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
+
+// Handles proxySessionPath on the proxy host
+func proxySessionHandler(w http.ResponseWriter, r *http.Request) {
+	username, err := consumeProxyLoginToken(r.URL.Query().Get("token"))
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+	session, _ := SessionStore.Get(r, "proxy-session")
+	session.Values["auth_user"] = username
+	// Scripts can't read it, and other sites can't send requests with it.
+	// It's only sent over HTTPS when that's how it was set, which behind a
+	// reverse proxy is told by X-Forwarded-Proto.
+	secure := r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+	session.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   86400 * 30,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteStrictMode,
+	}
+	session.Save(r, w)
+	next := r.URL.Query().Get("next")
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = "/"
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func proxyIdentitiesHandler(w http.ResponseWriter, r *http.Request) {
+	user := getAuthUser(r)
+	if !user.LoggedIn {
+		renderDefaultError(w, http.StatusForbidden)
+		return
+	}
+	if r.Method == "POST" {
+		r.ParseForm()
+		switch r.URL.Path {
+		case "/proxy-identities/new":
+			// Posted from the proxy when a capsule asks for a certificate
+			target, err := url.Parse(r.Form.Get("url"))
+			if err != nil || target.Scheme != "gemini" || target.Hostname() == "" {
+				renderError(w, "Invalid capsule URL", http.StatusBadRequest)
+				return
+			}
+			err = createProxyIdentity(user.Username, target.Hostname(), r.Form.Get("name"))
+			if err != nil {
+				log.Println(err)
+				renderError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			redirectToProxy(w, r, user.Username, "/"+target.Host+target.RequestURI())
+			return
+		case "/proxy-identities/delete":
+			id, _ := strconv.Atoi(r.Form.Get("id"))
+			_, err := DB.Exec("DELETE FROM proxy_identity WHERE id = ? AND username = ?", id, user.Username)
+			if err != nil {
+				serverError(w, err)
+				return
+			}
+		case "/proxy-identities/connect":
+			redirectToProxy(w, r, user.Username, "/")
+			return
+		}
+		http.Redirect(w, r, "/proxy-identities", http.StatusSeeOther)
+		return
+	}
+	identities, err := getProxyIdentities(user.Username)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+	data := struct {
+		Config     Config
+		AuthUser   AuthUser
+		Identities []ProxyIdentity
+		Enabled    bool
+	}{c, user, identities, c.SecretKey != ""}
+	err = t.ExecuteTemplate(w, "proxy_identities.html", data)
+	if err != nil {
+		serverError(w, err)
+		return
+	}
+}
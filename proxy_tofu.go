@@ -0,0 +1,87 @@
+// Trust on first use for certificates of capsules visited through the proxy
+package main
+
+import (
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"git.sr.ht/~adnano/go-gemini/tofu"
+)
+
+type certMismatchError struct {
+	Hostname string
+	Pinned   string // fingerprint of the known certificate
+	Received string // fingerprint of the certificate the server sent
+	Expires  time.Time
+}
+
+func (e *certMismatchError) Error() string {
+	return fmt.Sprintf("certificate for %s does not match the known certificate", e.Hostname)
+}
+
+// Pin the certificate of a host the first time we see it. Later
+// connections must present the same certificate until the pin expires.
+func trustProxyCertificate(hostname string, cert *x509.Certificate) error {
+	host := tofu.NewHost(hostname, cert.Raw, cert.NotAfter)
+	fingerprint := host.Fingerprint.String()
+	row := DB.QueryRow("SELECT fingerprint, expires FROM proxy_known_host WHERE hostname = ?", hostname)
+	var pinned string
+	var expires int64
+	err := row.Scan(&pinned, &expires)
+	if err == sql.ErrNoRows || (err == nil && time.Now().Unix() > expires) {
+		// First use, or the pinned certificate has expired
+		_, err = DB.Exec("INSERT OR REPLACE INTO proxy_known_host (hostname, fingerprint, expires) VALUES (?, ?, ?)", hostname, fingerprint, cert.NotAfter.Unix())
+		return err
+	} else if err != nil {
+		return err
+	}
+	if pinned != fingerprint {
+		return &certMismatchError{hostname, pinned, fingerprint, time.Unix(expires, 0)}
+	}
+	return nil
+}
+
+type KnownHost struct {
+	Hostname    string
+	Fingerprint string
+	Expires     int64 // timestamp
+	CreatedAt   int64 // timestamp
+}
+
+func getKnownHosts() ([]KnownHost, error) {
+	rows, err := DB.Query("SELECT hostname, fingerprint, expires, created_at FROM proxy_known_host ORDER BY hostname")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var hosts []KnownHost
+	for rows.Next() {
+		var h KnownHost
+		err = rows.Scan(&h.Hostname, &h.Fingerprint, &h.Expires, &h.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, nil
+}
+
+// Remove the pinned certificate for a host, so the next one seen is trusted
+func forgetKnownHost(hostname string) error {
+	res, err := DB.Exec("DELETE FROM proxy_known_host WHERE hostname = ?", hostname)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("No pinned certificate for %s", hostname)
+	}
+	log.Println("Cleared pinned proxy certificate for", hostname)
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"testing"
+	"time"
+
+	"git.sr.ht/~adnano/go-gemini/certificate"
+)
+
+func newTestCertificate(t *testing.T, hostname string) *x509.Certificate {
+	t.Helper()
+	cert, err := certificate.Create(certificate.CreateOptions{
+		DNSNames: []string{hostname},
+		Subject:  pkix.Name{CommonName: hostname},
+		Duration: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Leaf
+}
+
+func TestTrustProxyCertificate(t *testing.T) {
+	defer setupStorageTest(t)()
+	first := newTestCertificate(t, "example.org")
+	second := newTestCertificate(t, "example.org")
+	other := newTestCertificate(t, "other.example.org")
+	tests := []struct {
+		desc     string
+		hostname string
+		cert     *x509.Certificate
+		expire   bool // the pin expires first
+		mismatch bool
+	}{
+		{"first use is pinned", "example.org", first, false, false},
+		{"same certificate", "example.org", first, false, false},
+		{"changed certificate", "example.org", second, false, true},
+		{"other hosts are separate", "other.example.org", other, false, false},
+		{"expired pin is replaced", "example.org", second, true, false},
+		{"replaced pin is used", "example.org", first, false, true},
+	}
+	for _, tt := range tests {
+		if tt.expire {
+			DB.Exec("UPDATE proxy_known_host SET expires = ? WHERE hostname = ?", time.Now().Add(-time.Minute).Unix(), tt.hostname)
+		}
+		err := trustProxyCertificate(tt.hostname, tt.cert)
+		var mismatch *certMismatchError
+		if tt.mismatch {
+			if !errors.As(err, &mismatch) || mismatch.Hostname != tt.hostname || mismatch.Pinned == mismatch.Received {
+				t.Errorf("%s: got %v, want a mismatch", tt.desc, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", tt.desc, err)
+		}
+	}
+	if err := forgetKnownHost("example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := trustProxyCertificate("example.org", first); err != nil {
+		t.Errorf("Forgotten host should be pinned again, got %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+// Full-text search of public pages, using the search_index table
+package main
+
+import (
+	"encoding/binary"
+	"html"
+	"html/template"
+	"strings"
+	"unicode"
+)
+
+const maxSearchResults = 50
+
+// Marks matches in snippets, replaced when rendering
+const snippetStart, snippetEnd = "\x02", "\x03"
+
+type SearchResult struct {
+	Creator     string
+	Name        string
+	Title       string
+	Host        string
+	Snippet     string
+	SnippetHTML template.HTML // with matches in <mark>
+	score       int
+}
+
+// Turn what the user typed into an FTS query matching all the words.
+// Quoting each word keeps FTS operators from being interpreted.
+func ftsQuery(q string) string {
+	words := strings.FieldsFunc(q, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	if len(words) > 10 {
+		words = words[:10]
+	}
+	for i, word := range words {
+		words[i] = `"` + word + `"`
+	}
+	return strings.Join(words, " ")
+}
+
+// Search the text of listed users' pages, or of one user's pages if site is
+// set. The best matches come first, with matches in titles counting more.
+// They're ranked in SQL with searchScore, so the limit keeps the best ones.
+func searchFiles(q string, site string) ([]SearchResult, error) {
+	query := ftsQuery(q)
+	if query == "" {
+		return nil, nil
+	}
+	rows, err := DB.Query(`SELECT search_index.username, name, search_index.title,
+  snippet(search_index, ?, ?, '…', 4, 16), search_score(matchinfo(search_index, 'pcx')) AS score
+  FROM search_index JOIN user ON user.username = search_index.username
+  LEFT JOIN site_config ON site_config.username = search_index.username
+  WHERE search_index MATCH ? AND user.active AND (user.username = ? OR (? = '' AND coalesce(site_config.listed, user.listed)))
+  ORDER BY score DESC LIMIT ?`, snippetStart, snippetEnd, query, site, site, maxSearchResults)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var results []SearchResult
+	for rows.Next() {
+		var r SearchResult
+		err = rows.Scan(&r.Creator, &r.Name, &r.Title, &r.Snippet, &r.score)
+		if err != nil {
+			return nil, err
+		}
+		// Keep snippets to one line
+		r.Snippet = strings.Join(strings.Fields(r.Snippet), " ")
+		r.Host = c.Host
+		r.SnippetHTML = template.HTML(strings.NewReplacer(snippetStart, "<mark>", snippetEnd, "</mark>").
+			Replace(html.EscapeString(r.Snippet)))
+		r.Snippet = strings.NewReplacer(snippetStart, "", snippetEnd, "").Replace(r.Snippet)
+		results = append(results, r)
+	}
+	return results, rows.Err()
+}
+
+// Score from matchinfo 'pcx': the phrase and column counts, then for each
+// phrase and column the hits in this row, hits in all rows and rows with
+// hits. Values are 32 bit unsigned ints in machine byte order, which is
+// little endian on anything we run on.
+func searchScore(matchinfo []byte) int {
+	const titleColumn, contentColumn = 3, 4
+	if len(matchinfo) < 8 {
+		return 0
+	}
+	values := make([]int, len(matchinfo)/4)
+	for i := range values {
+		values[i] = int(binary.LittleEndian.Uint32(matchinfo[i*4:]))
+	}
+	phrases, columns := values[0], values[1]
+	score := 0
+	for p := 0; p < phrases; p++ {
+		hits := func(column int) int {
+			i := 2 + 3*(p*columns+column)
+			if i >= len(values) {
+				return 0
+			}
+			return values[i]
+		}
+		score += 5*hits(titleColumn) + hits(contentColumn)
+	}
+	return score
+}
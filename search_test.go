@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestFtsQuery(t *testing.T) {
+	for q, want := range map[string]string{
+		"hello world":           `"hello" "world"`,
+		`fish OR "NEAR" -bird*`: `"fish" "OR" "NEAR" "bird"`,
+		"   ":                   "",
+		"café déjà-vu":          `"café" "déjà" "vu"`,
+	} {
+		if got := ftsQuery(q); got != want {
+			t.Errorf("ftsQuery(%q) = %q, want %q", q, got, want)
+		}
+	}
+}
+
+func TestSearchFiles(t *testing.T) {
+	defer setupStorageTest(t)()
+	c.OkExtensions = append(c.OkExtensions, "")
+	addTestUser(t, "alex", true)
+	DB.Exec(`INSERT INTO user (username, email, password_hash, active, listed) VALUES ('bob', 'bob@example.com', '', true, false)`)
+	store.Mkdir("bob")
+	names := func(q string, site string) string {
+		t.Helper()
+		results, err := searchFiles(q, site)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, r := range results {
+			names = append(names, r.Creator+"/"+r.Name)
+		}
+		return strings.Join(names, " ")
+	}
+	writeUserFile("alex", "body.gmi", strings.NewReader("# Other\nAll about flounder, flounder."))
+	writeUserFile("alex", "title.gmi", strings.NewReader("# Flounder\nA fish."))
+	writeUserFile("alex", HiddenFolder+"/secret.gmi", strings.NewReader("flounder"))
+	writeUserFile("bob", "index.gmi", strings.NewReader("flounder"))
+	// Matches in titles rank higher, and hidden and unlisted pages are left out
+	if got := names("flounder", ""); got != "alex/title.gmi alex/body.gmi" {
+		t.Errorf("Got %q", got)
+	}
+	if got := names("flounder", "bob"); got != "bob/index.gmi" {
+		t.Errorf("Searching one site got %q", got)
+	}
+	if got := names("flounder fish", ""); got != "alex/title.gmi" {
+		t.Errorf("All words should match, got %q", got)
+	}
+
+	results, _ := searchFiles("about", "alex")
+	if len(results) != 1 || !strings.Contains(string(results[0].SnippetHTML), "<mark>about</mark>") {
+		t.Errorf("Bad snippet: %+v", results)
+	}
+
+	renameUserFile("alex", "title.gmi", HiddenFolder+"/title.gmi")
+	deleteUserFile("alex", "body.gmi")
+	if got := names("flounder", ""); got != "" {
+		t.Errorf("Moved and deleted pages are still found: %q", got)
+	}
+	renameUserFile("alex", HiddenFolder, "public")
+	if got := names("flounder", "alex"); got != "alex/public/secret.gmi alex/public/title.gmi" && got != "alex/public/title.gmi alex/public/secret.gmi" {
+		t.Errorf("Pages moved out of a hidden folder aren't found: %q", got)
+	}
+}
+
+func TestSearchRanksBeforeLimit(t *testing.T) {
+	defer setupStorageTest(t)()
+	addTestUser(t, "alex", true)
+	for i := 0; i < maxSearchResults*2; i++ {
+		DB.Exec("INSERT INTO search_index (username, name, updated_at, title, content) VALUES ('alex', ?, 0, 'Page', 'flounder')",
+			fmt.Sprintf("%d.gmi", i))
+	}
+	DB.Exec("INSERT INTO search_index (username, name, updated_at, title, content) VALUES ('alex', 'best.gmi', 0, 'Flounder', 'flounder')")
+	results, err := searchFiles("flounder", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != maxSearchResults || results[0].Name != "best.gmi" {
+		t.Errorf("Got %d results, first %v", len(results), results[0])
+	}
+}
@@ -13,8 +13,6 @@ import (
 	"log"
 	"net"
 	"os"
-	"path"
-	"path/filepath"
 	"runtime/debug"
 	"time"
 
@@ -28,9 +26,7 @@ type Connection struct {
 
 func (con *Connection) Fileread(request *sftp.Request) (io.ReaderAt, error) {
 	// check user perms -- cant read others hidden files
-	userDir := getUserDirectory(con.User) // NOTE -- not cross platform
-	fullpath := path.Join(userDir, filepath.Clean(request.Filepath))
-	f, err := os.OpenFile(fullpath, os.O_RDONLY, 0)
+	f, err := store.Open(userFilePath(con.User, request.Filepath))
 	if err != nil {
 		return nil, err
 	}
@@ -39,35 +35,21 @@ func (con *Connection) Fileread(request *sftp.Request) (io.ReaderAt, error) {
 
 func (conn *Connection) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 	// check user perms -- cant write others files
-	userDir := getUserDirectory(conn.User) // NOTE -- not cross platform
-	fullpath := path.Join(userDir, filepath.Clean(request.Filepath))
-	err := checkIfValidFile(conn.User, fullpath, []byte{})
-	if err != nil {
-		return nil, err
-	}
-	f, err := os.OpenFile(fullpath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
-	if err != nil {
-		return nil, err
-	}
-	return f, nil
+	// The file is only replaced once the transfer has finished
+	return newUserFileWriter(conn.User, request.Filepath)
 }
 
 func (conn *Connection) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
-	userDir := getUserDirectory(conn.User) // NOTE -- not cross platform
-	fullpath := path.Join(userDir, filepath.Clean(request.Filepath))
+	fullpath := userFilePath(conn.User, request.Filepath)
 	switch request.Method {
 	case "List":
-		f, err := os.Open(fullpath)
-		if err != nil {
-			return nil, err
-		}
-		fileInfo, err := f.Readdir(-1)
+		fileInfo, err := store.ReadDir(fullpath)
 		if err != nil {
 			return nil, err
 		}
 		return listerat(fileInfo), nil
 	case "Stat":
-		stat, err := os.Stat(fullpath)
+		stat, err := store.Stat(fullpath)
 		if err != nil {
 			return nil, err
 		}
@@ -78,21 +60,14 @@ func (conn *Connection) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
 
 func (conn *Connection) Filecmd(request *sftp.Request) error {
 	// remove, rename, setstat? find out
-	userDir := getUserDirectory(conn.User) // NOTE -- not cross platform
-	fullpath := path.Join(userDir, filepath.Clean(request.Filepath))
-	targetPath := path.Join(userDir, filepath.Clean(request.Target))
 	var err error
 	switch request.Method {
 	case "Remove":
-		err = os.Remove(fullpath)
+		err = deleteUserFile(conn.User, request.Filepath)
 	case "Mkdir":
-		err = os.Mkdir(fullpath, 0755)
+		err = makeUserFolder(conn.User, request.Filepath)
 	case "Rename":
-		err := checkIfValidFile(conn.User, targetPath, []byte{})
-		if err != nil {
-			return err
-		}
-		err = os.Rename(fullpath, targetPath)
+		err = renameUserFile(conn.User, request.Filepath, request.Target)
 	}
 	if err != nil {
 		return err
@@ -106,10 +81,10 @@ func (conn *Connection) Filecmd(request *sftp.Request) error {
 
 func buildHandlers(connection *Connection) sftp.Handlers {
 	return sftp.Handlers{
-		connection,
-		connection,
-		connection,
-		connection,
+		FileGet:  connection,
+		FilePut:  connection,
+		FileCmd:  connection,
+		FileList: connection,
 	}
 }
 
@@ -0,0 +1,211 @@
+// Site settings from a site.toml file in the root of a user's site. It's
+// parsed when it changes, and kept in the site_config table. Settings in the
+// file take precedence over the defaults, over the theme settings page, and
+// over the listing setting on the account page while they're in the file.
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/text/language"
+)
+
+const siteConfigFile = "site.toml"
+
+// Shown when creating a site.toml
+const exampleSiteConfig = `# Settings for your site. Remove the # from the start of a line to use it.
+
+# title = "My Site"
+# author = "Your Name"
+# language = "en"
+# description = "What this site is about"
+# license = "CC BY-SA 4.0"
+
+# Set to false to keep your site off the home page
+# listed = true
+
+# Your gemlog feed
+# [feed]
+# title = "My Gemlog"
+# description = "Posts about things"
+
+# How your site looks on the web
+# [theme]
+# stylesheet = "style.css"
+# favicon = "favicon.png"
+# title_format = "{title} | {site}"
+# header = "=> / Home"
+# footer = "Thanks for reading!"
+`
+
+type SiteFeedConfig struct {
+	Title       string `toml:"title"`
+	Description string `toml:"description"`
+}
+
+type SiteConfig struct {
+	Title       string         `toml:"title"`
+	Author      string         `toml:"author"`
+	Language    string         `toml:"language"`
+	Description string         `toml:"description"`
+	License     string         `toml:"license"`
+	Listed      *bool          `toml:"listed"`
+	Feed        SiteFeedConfig `toml:"feed"`
+	Theme       SiteTheme      `toml:"theme"`
+}
+
+// Parse and validate a site.toml. Unknown settings are errors, so typos
+// don't go unnoticed.
+func parseSiteConfig(content []byte) (*SiteConfig, error) {
+	var s SiteConfig
+	md, err := toml.DecodeReader(bytes.NewReader(content), &s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s: %v", siteConfigFile, err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("Unknown setting in %s: %s", siteConfigFile, undecoded[0])
+	}
+	if len(s.Title) > 200 || len(s.Author) > 200 || len(s.License) > 200 || len(s.Feed.Title) > 200 {
+		return nil, fmt.Errorf("Title, author or license too long in %s", siteConfigFile)
+	}
+	if len(s.Description) > 1000 || len(s.Feed.Description) > 1000 {
+		return nil, fmt.Errorf("Description too long in %s", siteConfigFile)
+	}
+	if s.Language != "" {
+		tag, err := language.Parse(s.Language)
+		if err != nil {
+			return nil, fmt.Errorf("Unknown language in %s: %s", siteConfigFile, s.Language)
+		}
+		s.Language = tag.String()
+	}
+	err = s.Theme.validate()
+	if err != nil {
+		return nil, fmt.Errorf("%v in %s", err, siteConfigFile)
+	}
+	return &s, nil
+}
+
+// Read the user's site.toml again after it changed. If it can't be used,
+// the error is kept to show the user, and the site has no settings.
+func loadSiteConfig(username string) error {
+	content, err := readStorageFile(path.Join(getUserDirectory(username), siteConfigFile))
+	if os.IsNotExist(err) {
+		_, err = DB.Exec("DELETE FROM site_config WHERE username = ?", username)
+		return err
+	} else if err != nil {
+		return err
+	}
+	s, parseErr := parseSiteConfig(content)
+	errorText := ""
+	if parseErr != nil {
+		errorText = parseErr.Error()
+		s = &SiteConfig{}
+	}
+	_, err = DB.Exec(`INSERT OR REPLACE INTO site_config (username, content, error, title, author, language,
+  description, license, listed, feed_title, feed_description, stylesheet, favicon, title_format, header, footer)
+  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		username, string(content), errorText, s.Title, s.Author, s.Language, s.Description, s.License, s.Listed,
+		s.Feed.Title, s.Feed.Description, s.Theme.Stylesheet, s.Theme.Favicon, s.Theme.TitleFormat, s.Theme.Header, s.Theme.Footer)
+	return err
+}
+
+// The user's settings, empty if they have no usable site.toml
+func getSiteConfig(username string) *SiteConfig {
+	var s SiteConfig
+	var listed sql.NullBool
+	err := DB.QueryRow(`SELECT title, author, language, description, license, listed, feed_title, feed_description,
+  stylesheet, favicon, title_format, header, footer FROM site_config WHERE username = ?`, username).Scan(
+		&s.Title, &s.Author, &s.Language, &s.Description, &s.License, &listed, &s.Feed.Title, &s.Feed.Description,
+		&s.Theme.Stylesheet, &s.Theme.Favicon, &s.Theme.TitleFormat, &s.Theme.Header, &s.Theme.Footer)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Println(err)
+		}
+		return &SiteConfig{}
+	}
+	if listed.Valid {
+		s.Listed = &listed.Bool
+	}
+	return &s
+}
+
+// Why the user's site.toml isn't being used, if it isn't
+func getSiteConfigError(username string) (string, error) {
+	var errorText string
+	err := DB.QueryRow("SELECT error FROM site_config WHERE username = ?", username).Scan(&errorText)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return errorText, err
+}
+
+// Site titles of listed users that have one, by username
+func getSiteTitles() (map[string]string, error) {
+	rows, err := DB.Query(`SELECT site_config.username, title FROM site_config JOIN user ON user.username = site_config.username
+  WHERE user.active AND coalesce(site_config.listed, user.listed) AND title != ''`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	titles := map[string]string{}
+	for rows.Next() {
+		var username, title string
+		err = rows.Scan(&username, &title)
+		if err != nil {
+			return nil, err
+		}
+		titles[username] = title
+	}
+	return titles, rows.Err()
+}
+
+// The author's name, or the username
+func (s *SiteConfig) author(username string) string {
+	if s.Author != "" {
+		return s.Author
+	}
+	return username
+}
+
+// The author, license and description of a feed of the user's pages
+func (s *SiteConfig) applyToFeed(feed *Gemfeed, username string) {
+	feed.Creator = s.author(username)
+	feed.Rights = s.License
+	if feed.Subtitle == "" {
+		feed.Subtitle = s.Description
+	}
+}
+
+// Gemlog feed settings fill in what isn't set on the feeds page
+func (s *SiteConfig) fillFeedFolder(f *FeedFolder) {
+	if f.Folder != GemlogFolder {
+		return
+	}
+	if f.Title == "" {
+		f.Title = s.Feed.Title
+	}
+	if f.Description == "" {
+		f.Description = s.Feed.Description
+	}
+}
+
+// Settings in the file override those from the theme page
+func (s *SiteConfig) applyTheme(theme *SiteTheme) {
+	for _, setting := range []struct{ from, to *string }{
+		{&s.Theme.Stylesheet, &theme.Stylesheet},
+		{&s.Theme.Favicon, &theme.Favicon},
+		{&s.Theme.TitleFormat, &theme.TitleFormat},
+		{&s.Theme.Header, &theme.Header},
+		{&s.Theme.Footer, &theme.Footer},
+	} {
+		if *setting.from != "" {
+			*setting.to = *setting.from
+		}
+	}
+}
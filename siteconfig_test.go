@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSiteConfig(t *testing.T) {
+	defer setupStorageTest(t)()
+	c.MaxFileBytes = 1000
+	c.CustomThemes = true
+	addTestUser(t, "alex", false)
+	for _, content := range []string{"titel = \"Typo\"", "language = \"not a language\"", "[theme]\nstylesheet = \"page.gmi\""} {
+		if _, err := parseSiteConfig([]byte(content)); err == nil {
+			t.Errorf("%q should be refused", content)
+		}
+	}
+	if err := checkIfValidFile("alex", "site.toml", []byte("title = 1")); err == nil {
+		t.Errorf("Invalid site.toml should be refused")
+	}
+	err := writeUserFile("alex", "site.toml", strings.NewReader(`title = "Alex's Place"
+language = "en-gb"
+listed = false
+[feed]
+title = "Notes from Alex"
+[theme]
+title_format = "{title} - {site}"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	site := getSiteConfig("alex")
+	if site.Title != "Alex's Place" || site.Language != "en-GB" {
+		t.Errorf("Got %+v", site)
+	}
+	// Settings are read back as they were parsed when the file was saved
+	DB.Exec("UPDATE site_config SET content = ''")
+	if got := getSiteConfig("alex"); got.Title != site.Title || got.Feed.Title != "Notes from Alex" || got.Theme.TitleFormat == "" {
+		t.Errorf("Got %+v", got)
+	}
+	// The file overrides the account setting without changing it
+	DB.Exec("UPDATE user SET active = true WHERE username = 'alex'")
+	listed := func() bool {
+		t.Helper()
+		users, err := getListedUserNames()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, u := range users {
+			if u == "alex" {
+				return true
+			}
+		}
+		return false
+	}
+	if listed() {
+		t.Errorf("Site should be unlisted")
+	}
+	if me, _ := getUserByName("alex"); !me.Listed {
+		t.Errorf("Account setting was changed")
+	}
+	if got := defaultFeedTitle("alex", GemlogFolder); got != "Notes from Alex" {
+		t.Errorf("Got gemlog title %q", got)
+	}
+	if got := defaultFeedTitle("alex", "recipes"); got != "Alex's Place: Recipes" {
+		t.Errorf("Got feed title %q", got)
+	}
+	if got := pageTheme("alex").PageTitle("Hello", site.Title); got != "Hello - Alex's Place" {
+		t.Errorf("Got page title %q", got)
+	}
+	writeUserFile("alex", "site.toml", strings.NewReader("title = \"Unclosed"))
+	if msg, _ := getSiteConfigError("alex"); msg == "" || getSiteConfig("alex").Title != "" {
+		t.Errorf("Broken site.toml should be reported and not used")
+	}
+	deleteUserFile("alex", "site.toml")
+	if !listed() {
+		t.Errorf("Site should be listed again without site.toml")
+	}
+	if got := defaultFeedTitle("alex", GemlogFolder); got != "Alex's Gemlog" {
+		t.Errorf("Got gemlog title %q after deleting site.toml", got)
+	}
+}
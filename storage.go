@@ -0,0 +1,363 @@
+// Where user files are kept. All access to user files goes through the
+// Storage interface, so that they can live on the local disk or in an
+// object store.
+//
+// Changes to user files go through the helpers below, so that writes are
+// atomic and the quota check and the write happen together under a
+// per-user lock.
+package main
+
+import (
+	"fmt"
+	gmi "git.sr.ht/~adnano/go-gemini"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Names are slash separated and relative to the root of the storage, e.g.
+// "alex/gemlog/index.gmi". Errors for missing files satisfy os.IsNotExist.
+type Storage interface {
+	Stat(name string) (os.FileInfo, error)
+	Open(name string) (StorageFile, error)
+	// Replace the file with the contents of r. Readers see either the old
+	// file or the new one, never a partial write.
+	Write(name string, r io.Reader) error
+	// A temp file to spool a write to before it's committed
+	TempFile() (*os.File, error)
+	// Replace the file with a temp file from TempFile, like Write
+	Commit(name string, tmp *os.File) error
+	// Sorted by name
+	ReadDir(name string) ([]os.FileInfo, error)
+	Rename(oldName string, newName string) error
+	// Remove a file or an empty folder
+	Remove(name string) error
+	RemoveAll(name string) error
+	Mkdir(name string) error
+	// Like filepath.Walk, with storage names
+	Walk(root string, fn filepath.WalkFunc) error
+}
+
+type StorageFile interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+}
+
+var store Storage
+
+func initStorage() {
+	switch c.StorageBackend {
+	case "", "local":
+		store = &LocalStorage{Root: c.FilesDirectory}
+	case "s3":
+		store = &S3Storage{
+			Endpoint:       c.S3Endpoint,
+			Bucket:         c.S3Bucket,
+			Region:         c.S3Region,
+			AccessKey:      c.S3AccessKey,
+			SecretKey:      c.S3SecretKey,
+			SpoolDirectory: c.S3SpoolDirectory,
+		}
+	default:
+		panic("Unknown StorageBackend " + c.StorageBackend)
+	}
+}
+
+// Clean a name so it can't escape the root, e.g. "/../a/./b" -> "a/b"
+func cleanStorageName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
+
+// Read a whole file, like ioutil.ReadFile
+func readStorageFile(name string) ([]byte, error) {
+	f, err := store.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// Serves files from a user's folder over gemini, with index.gmi for folders
+type storageFS struct {
+	Root string
+}
+
+func (fs storageFS) Open(name string) (gmi.File, error) {
+	p := path.Join(fs.Root, cleanStorageName(name))
+	info, err := store.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		p = path.Join(p, "index.gmi")
+	}
+	return store.Open(p)
+}
+
+var userLocks = make(map[string]*sync.Mutex)
+var userLocksMu sync.Mutex
+
+// Lock a user's files, returning the function to unlock them
+func lockUser(username string) func() {
+	userLocksMu.Lock()
+	m, ok := userLocks[username]
+	if !ok {
+		m = &sync.Mutex{}
+		userLocks[username] = m
+	}
+	userLocksMu.Unlock()
+	m.Lock()
+	return m.Unlock
+}
+
+// Storage name of a file in a user's folder. The name can't escape it.
+func userFilePath(username string, filename string) string {
+	return path.Join(getUserDirectory(username), cleanStorageName(filename))
+}
+
+// Move a finished temp file from store.TempFile into place, if the user has
+// space for it
+func commitUserFile(username string, filename string, tmp *os.File) error {
+	info, err := tmp.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	unlock := lockUser(username)
+	defer unlock()
+	err = checkFileName(filename)
+	if err != nil {
+		return err
+	}
+	destPath := userFilePath(username, filename)
+	usage, err := getUserUsage(username)
+	if err != nil {
+		return err
+	}
+	var replaced int64
+	files := 1
+	if existing, err := store.Stat(destPath); err == nil {
+		replaced, files = existing.Size(), 0
+	}
+	if usage.Files+files > c.MaxFilesPerUser {
+		return fmt.Errorf("You have reached the max number of files. Delete some before uploading")
+	}
+	if usage.Bytes-replaced+info.Size() > c.MaxUserBytes {
+		return fmt.Errorf("You are out of storage space. Delete some files before continuing.")
+	}
+	var content []byte
+	if isSearchable(filename) {
+		content, err = ioutil.ReadAll(tmp)
+		if err != nil {
+			return err
+		}
+	}
+	err = store.Commit(destPath, tmp)
+	if err != nil {
+		return err
+	}
+	// Use the time from storage, so reindexing sees this version as indexed
+	updated := time.Now()
+	if written, err := store.Stat(destPath); err == nil {
+		updated = written.ModTime()
+	}
+	err = indexFile(username, filename, updated, content)
+	if err != nil {
+		return err
+	}
+	return addUserUsage(username, info.Size()-replaced, files)
+}
+
+// How much of a file can be written: MaxFileBytes, or the user's remaining
+// space if that's less. The space of a file being replaced counts as free.
+// It's checked again when the file is committed.
+func writeLimit(username string, filename string) (int64, error) {
+	usage, err := getUserUsage(username)
+	if err != nil {
+		return 0, err
+	}
+	free := c.MaxUserBytes - usage.Bytes
+	if existing, err := store.Stat(userFilePath(username, filename)); err == nil {
+		free += existing.Size()
+	}
+	limit := int64(c.MaxFileBytes)
+	if free < limit {
+		limit = free
+	}
+	if limit < 0 {
+		limit = 0
+	}
+	return limit, nil
+}
+
+func writeLimitError(limit int64) error {
+	if limit < int64(c.MaxFileBytes) {
+		return fmt.Errorf("You are out of storage space. Delete some files before continuing.")
+	}
+	return fmt.Errorf("File too large. Max file size is %d", c.MaxFileBytes)
+}
+
+// Stream a file into a user's folder. It's spooled to a temp file in the
+// storage's temp area while counting bytes against the write limit, then
+// committed in one go, so a partial file is never visible.
+func writeUserFile(username string, filename string, r io.Reader) error {
+	// Fail early on a bad name, before reading anything
+	err := checkUserFile(username, filename, 0)
+	if err != nil {
+		return err
+	}
+	limit, err := writeLimit(username, filename)
+	if err != nil {
+		return err
+	}
+	tmp, err := store.TempFile()
+	if err != nil {
+		return err
+	}
+	// Does nothing once the file has been moved
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	// Read one byte past the limit to tell if the file is too big
+	n, err := io.Copy(tmp, io.LimitReader(r, limit+1))
+	if err != nil {
+		return err
+	}
+	if n > limit {
+		return writeLimitError(limit)
+	}
+	return commitUserFile(username, filename, tmp)
+}
+
+func renameUserFile(username string, oldName string, newName string) error {
+	err := checkFileName(newName)
+	if err != nil {
+		return err
+	}
+	unlock := lockUser(username)
+	defer unlock()
+	oldPath, newPath := userFilePath(username, oldName), userFilePath(username, newName)
+	if oldPath == newPath {
+		return nil
+	}
+	// Whatever is replaced no longer counts
+	var replaced Usage
+	if _, err := store.Stat(newPath); err == nil {
+		replaced, err = pathUsage(newPath)
+		if err != nil {
+			return err
+		}
+	}
+	err = store.Rename(oldPath, newPath)
+	if err != nil {
+		return err
+	}
+	if replaced.Files > 0 {
+		err = addUserUsage(username, -replaced.Bytes, -replaced.Files)
+		if err != nil {
+			return err
+		}
+	}
+	err = renameIndexedFile(username, oldName, newName)
+	if err != nil {
+		return err
+	}
+	err = renameThemeFiles(username, oldName, newName)
+	if err != nil {
+		return err
+	}
+	return renameFeedFolder(username, oldName, newName)
+}
+
+func deleteUserFile(username string, filename string) error {
+	unlock := lockUser(username)
+	defer unlock()
+	p := userFilePath(username, filename)
+	info, err := store.Stat(p)
+	if err != nil {
+		return err
+	}
+	err = store.Remove(p)
+	if err != nil {
+		return err
+	}
+	err = unindexFile(username, filename)
+	if err != nil || info.IsDir() {
+		return err
+	}
+	return addUserUsage(username, -info.Size(), -1)
+}
+
+func makeUserFolder(username string, name string) error {
+	unlock := lockUser(username)
+	defer unlock()
+	return store.Mkdir(userFilePath(username, name))
+}
+
+// A file being written at arbitrary offsets, e.g. over SFTP. It's written
+// to a temp file and committed when closed, unless the transfer failed.
+type userFileWriter struct {
+	username string
+	filename string
+	limit    int64 // see writeLimit
+	tmp      *os.File
+	mu       sync.Mutex
+	err      error
+}
+
+func newUserFileWriter(username string, filename string) (*userFileWriter, error) {
+	err := checkUserFile(username, filename, 0)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := writeLimit(username, filename)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := store.TempFile()
+	if err != nil {
+		return nil, err
+	}
+	return &userFileWriter{username: username, filename: filename, limit: limit, tmp: tmp}, nil
+}
+
+func (w *userFileWriter) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > w.limit {
+		err := writeLimitError(w.limit)
+		w.TransferError(err)
+		return 0, err
+	}
+	return w.tmp.WriteAt(p, off)
+}
+
+// Called by the SFTP server when the transfer fails
+func (w *userFileWriter) TransferError(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *userFileWriter) Close() error {
+	defer os.Remove(w.tmp.Name())
+	defer w.tmp.Close()
+	w.mu.Lock()
+	err := w.err
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return commitUserFile(w.username, w.filename, w.tmp)
+}
@@ -0,0 +1,102 @@
+// Storage on the local disk, rooted at FilesDirectory
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+type LocalStorage struct {
+	Root string
+}
+
+func (s *LocalStorage) path(name string) string {
+	return filepath.Join(s.Root, filepath.FromSlash(cleanStorageName(name)))
+}
+
+func (s *LocalStorage) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(s.path(name))
+}
+
+func (s *LocalStorage) Open(name string) (StorageFile, error) {
+	return os.Open(s.path(name))
+}
+
+// Written to a temp file on the same disk, then renamed into place
+func (s *LocalStorage) Write(name string, r io.Reader) error {
+	tmp, err := s.TempFile()
+	if err != nil {
+		return err
+	}
+	// Does nothing once the file has been moved
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		return err
+	}
+	return s.Commit(name, tmp)
+}
+
+// In TempFolder, on the same disk as the files, so committing is a rename
+func (s *LocalStorage) TempFile() (*os.File, error) {
+	tmpFolder := filepath.Join(s.Root, TempFolder)
+	os.MkdirAll(tmpFolder, os.ModePerm)
+	return ioutil.TempFile(tmpFolder, "write-")
+}
+
+func (s *LocalStorage) Commit(name string, tmp *os.File) error {
+	err := tmp.Chmod(0644)
+	if err != nil {
+		return err
+	}
+	dest := s.path(name)
+	os.MkdirAll(filepath.Dir(dest), os.ModePerm)
+	return os.Rename(tmp.Name(), dest)
+}
+
+func (s *LocalStorage) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(s.path(name))
+}
+
+func (s *LocalStorage) Rename(oldName string, newName string) error {
+	dest := s.path(newName)
+	os.MkdirAll(filepath.Dir(dest), os.ModePerm)
+	return os.Rename(s.path(oldName), dest)
+}
+
+func (s *LocalStorage) Remove(name string) error {
+	return os.Remove(s.path(name))
+}
+
+func (s *LocalStorage) RemoveAll(name string) error {
+	if cleanStorageName(name) == "" {
+		return os.ErrInvalid
+	}
+	return os.RemoveAll(s.path(name))
+}
+
+func (s *LocalStorage) Mkdir(name string) error {
+	return os.Mkdir(s.path(name), 0755)
+}
+
+func (s *LocalStorage) Walk(root string, fn filepath.WalkFunc) error {
+	root = cleanStorageName(root)
+	return filepath.Walk(s.path(root), func(p string, info os.FileInfo, err error) error {
+		rel, relErr := filepath.Rel(s.Root, p)
+		if relErr != nil {
+			return relErr
+		}
+		name := filepath.ToSlash(rel)
+		if name == "." {
+			name = ""
+		}
+		// The staging folder isn't part of anyone's files
+		if root == "" && name == TempFolder {
+			return filepath.SkipDir
+		}
+		return fn(name, info, err)
+	})
+}
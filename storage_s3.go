@@ -0,0 +1,532 @@
+// Storage in an S3 compatible object store, e.g. MinIO. Folders are key
+// prefixes, with an empty "folder/" object for folders made explicitly.
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type S3Storage struct {
+	Endpoint  string // e.g. https://s3.us-east-1.amazonaws.com, requests use path style
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+	// Where uploads are spooled before they're sent, the system's temp
+	// folder if empty
+	SpoolDirectory string
+}
+
+// os.FileInfo for objects and prefixes
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+func (fi *s3FileInfo) Name() string       { return path.Base(fi.name) }
+func (fi *s3FileInfo) Size() int64        { return fi.size }
+func (fi *s3FileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *s3FileInfo) IsDir() bool        { return fi.isDir }
+func (fi *s3FileInfo) Sys() interface{}   { return nil }
+func (fi *s3FileInfo) Mode() os.FileMode {
+	if fi.isDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// An object read into memory. Files are at most MaxFileBytes.
+type s3File struct {
+	*bytes.Reader
+	info *s3FileInfo
+}
+
+func (f *s3File) Stat() (os.FileInfo, error) { return f.info, nil }
+func (f *s3File) Close() error               { return nil }
+
+type s3Error struct {
+	Code    string
+	Message string
+}
+
+func notExist(op string, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+func (s *S3Storage) objectURL(key string) string {
+	return strings.TrimSuffix(s.Endpoint, "/") + "/" + s.Bucket + "/" + escapeS3Path(key)
+}
+
+// Make a signed request, returning an error for non-2xx responses
+func (s *S3Storage) do(method string, key string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	u := s.objectURL(key)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	sum := sha256.Sum256(body)
+	signS3Request(req, hex.EncodeToString(sum[:]), s.AccessKey, s.SecretKey, s.Region, time.Now())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, notExist(strings.ToLower(method), key)
+		}
+		var e s3Error
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		xml.Unmarshal(data, &e)
+		return nil, fmt.Errorf("S3 %s %s: %s %s %s", method, key, resp.Status, e.Code, e.Message)
+	}
+	return resp, nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+		Size         int64
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// List keys under a prefix, all the way down if delimiter is empty
+func (s *S3Storage) list(prefix string, delimiter string, fn func(r *s3ListResult) error) error {
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", query, nil, nil)
+		if err != nil {
+			return err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		err = fn(&result)
+		if err != nil {
+			return err
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3Storage) Stat(name string) (os.FileInfo, error) {
+	key := cleanStorageName(name)
+	if key == "" {
+		return &s3FileInfo{name: "", isDir: true}, nil
+	}
+	resp, err := s.do("HEAD", key, nil, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return &s3FileInfo{name: key, size: resp.ContentLength, modTime: modTime}, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	// Maybe a folder
+	var info *s3FileInfo
+	err = s.list(key+"/", "", func(r *s3ListResult) error {
+		for _, obj := range r.Contents {
+			if info == nil || obj.LastModified.After(info.modTime) {
+				info = &s3FileInfo{name: key, isDir: true, modTime: obj.LastModified}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		return nil, notExist("stat", name)
+	}
+	return info, nil
+}
+
+func (s *S3Storage) Open(name string) (StorageFile, error) {
+	key := cleanStorageName(name)
+	info, err := s.Stat(key)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &s3File{bytes.NewReader(nil), info.(*s3FileInfo)}, nil
+	}
+	resp, err := s.do("GET", key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	fi := info.(*s3FileInfo)
+	fi.size = int64(len(data))
+	return &s3File{bytes.NewReader(data), fi}, nil
+}
+
+// A PUT replaces the object atomically
+func (s *S3Storage) Write(name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do("PUT", cleanStorageName(name), nil, data, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) TempFile() (*os.File, error) {
+	return ioutil.TempFile(s.SpoolDirectory, "flounder-")
+}
+
+func (s *S3Storage) Commit(name string, tmp *os.File) error {
+	_, err := tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	return s.Write(name, tmp)
+}
+
+func (s *S3Storage) ReadDir(name string) ([]os.FileInfo, error) {
+	prefix := cleanStorageName(name)
+	if prefix != "" {
+		prefix += "/"
+	}
+	var infos []os.FileInfo
+	err := s.list(prefix, "/", func(r *s3ListResult) error {
+		for _, obj := range r.Contents {
+			if obj.Key == prefix {
+				continue // the folder marker
+			}
+			infos = append(infos, &s3FileInfo{name: obj.Key, size: obj.Size, modTime: obj.LastModified})
+		}
+		for _, p := range r.CommonPrefixes {
+			infos = append(infos, &s3FileInfo{name: strings.TrimSuffix(p.Prefix, "/"), isDir: true})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) == 0 {
+		if _, err := s.Stat(name); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	return infos, nil
+}
+
+func (s *S3Storage) copyObject(from string, to string) error {
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", "/"+s.Bucket+"/"+escapeS3Path(from))
+	resp, err := s.do("PUT", to, nil, nil, header)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Objects can't be renamed, so they are copied then deleted. Folders are
+// moved one object at a time.
+func (s *S3Storage) Rename(oldName string, newName string) error {
+	from, to := cleanStorageName(oldName), cleanStorageName(newName)
+	info, err := s.Stat(from)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		err = s.copyObject(from, to)
+		if err != nil {
+			return err
+		}
+		return s.Remove(from)
+	}
+	var keys []string
+	err = s.list(from+"/", "", func(r *s3ListResult) error {
+		for _, obj := range r.Contents {
+			keys = append(keys, obj.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err = s.copyObject(key, to+strings.TrimPrefix(key, from))
+		if err != nil {
+			return err
+		}
+	}
+	for _, key := range keys {
+		err = s.deleteKey(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *S3Storage) deleteKey(key string) error {
+	resp, err := s.do("DELETE", key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) Remove(name string) error {
+	key := cleanStorageName(name)
+	info, err := s.Stat(key)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		children, err := s.ReadDir(key)
+		if err != nil {
+			return err
+		}
+		if len(children) > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: fmt.Errorf("directory not empty")}
+		}
+		return s.deleteKey(key + "/")
+	}
+	return s.deleteKey(key)
+}
+
+func (s *S3Storage) RemoveAll(name string) error {
+	key := cleanStorageName(name)
+	if key == "" {
+		return os.ErrInvalid
+	}
+	var keys []string
+	err := s.list(key+"/", "", func(r *s3ListResult) error {
+		for _, obj := range r.Contents {
+			keys = append(keys, obj.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range append(keys, key) {
+		err = s.deleteKey(k)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *S3Storage) Mkdir(name string) error {
+	key := cleanStorageName(name)
+	if _, err := s.Stat(key); err == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	return s.Write(key+"/", bytes.NewReader(nil))
+}
+
+// Visits folders before their contents, in lexical order, like filepath.Walk
+func (s *S3Storage) Walk(root string, fn filepath.WalkFunc) error {
+	root = cleanStorageName(root)
+	rootInfo, err := s.Stat(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	if !rootInfo.IsDir() {
+		return fn(root, rootInfo, nil)
+	}
+	prefix := root
+	if prefix != "" {
+		prefix += "/"
+	}
+	// Collect everything first, so folders can be visited in order
+	infos := map[string]*s3FileInfo{root: rootInfo.(*s3FileInfo)}
+	err = s.list(prefix, "", func(r *s3ListResult) error {
+		for _, obj := range r.Contents {
+			name := strings.TrimSuffix(obj.Key, "/")
+			if !strings.HasSuffix(obj.Key, "/") {
+				infos[name] = &s3FileInfo{name: name, size: obj.Size, modTime: obj.LastModified}
+			}
+			for dir := path.Dir(name); dir != "." && strings.HasPrefix(dir+"/", prefix) && dir != root; dir = path.Dir(dir) {
+				if infos[dir] == nil {
+					infos[dir] = &s3FileInfo{name: dir, isDir: true}
+				}
+				if obj.LastModified.After(infos[dir].modTime) {
+					infos[dir].modTime = obj.LastModified
+				}
+			}
+			if strings.HasSuffix(obj.Key, "/") && infos[name] == nil {
+				infos[name] = &s3FileInfo{name: name, isDir: true, modTime: obj.LastModified}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	names := make([]string, 0, len(infos))
+	for name := range infos {
+		names = append(names, name)
+	}
+	// Sort by path components, so "a/b" comes before "a-b"
+	sort.Slice(names, func(i, j int) bool {
+		return lessPath(names[i], names[j])
+	})
+	var skipped []string
+	for _, name := range names {
+		isSkipped := false
+		for _, skip := range skipped {
+			if strings.HasPrefix(name, skip+"/") {
+				isSkipped = true
+			}
+		}
+		if isSkipped {
+			continue
+		}
+		info := infos[name]
+		err := fn(name, info, nil)
+		if err == filepath.SkipDir {
+			if info.IsDir() {
+				skipped = append(skipped, name)
+				continue
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func lessPath(a string, b string) bool {
+	as, bs := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// URI encode everything but unreserved characters and slashes, as SigV4
+// expects
+func escapeS3Path(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		ch := p[i]
+		if ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9' ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' || ch == '/' {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Sign a request with AWS Signature Version 4. All headers set on the
+// request are signed, along with the host.
+func signS3Request(req *http.Request, payloadHash string, accessKey string, secretKey string, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, headers[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	// Query values are sorted by key by Encode. Spaces must be %20.
+	query := strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		escapeS3Path(req.URL.Path),
+		query,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteUserFile(t *testing.T) {
+	defer setupStorageTest(t)()
+	c.MaxFileBytes = 10
+	c.MaxUserBytes = 15
+	if err := writeUserFile("alex", "big.gmi", strings.NewReader("01234567890")); err == nil {
+		t.Errorf("File over MaxFileBytes should be refused, but wasn't")
+	}
+	if err := writeUserFile("alex", "a.gmi", strings.NewReader("0123456789")); err != nil {
+		t.Error(err)
+	}
+	if err := writeUserFile("alex", "b.gmi", strings.NewReader("0123456789")); err == nil {
+		t.Errorf("File over the remaining space should be refused, but wasn't")
+	}
+	for _, name := range []string{"big.gmi", "b.gmi"} {
+		if _, err := os.Stat(path.Join(c.FilesDirectory, "alex", name)); !os.IsNotExist(err) {
+			t.Errorf("Refused file %s should not exist", name)
+		}
+	}
+	if tmp, _ := ioutil.ReadDir(path.Join(c.FilesDirectory, TempFolder)); len(tmp) > 0 {
+		t.Errorf("Temp files were left behind")
+	}
+}
+
+// Reads forever, noting where the spool file is
+type spoolCheckReader struct {
+	read    int64
+	spooled bool
+}
+
+func (r *spoolCheckReader) Read(p []byte) (int, error) {
+	if tmp, _ := ioutil.ReadDir(path.Join(c.FilesDirectory, TempFolder)); len(tmp) > 0 {
+		r.spooled = true
+	}
+	for i := range p {
+		p[i] = 'x'
+	}
+	r.read += int64(len(p))
+	return len(p), nil
+}
+
+func TestWriteIsSpooledInStorage(t *testing.T) {
+	defer setupStorageTest(t)()
+	c.MaxFileBytes = 1 << 20
+	c.MaxUserBytes = 1 << 10
+	r := &spoolCheckReader{}
+	if err := writeUserFile("alex", "big.gmi", r); err == nil {
+		t.Errorf("File over the remaining space should be refused, but wasn't")
+	}
+	if !r.spooled {
+		t.Errorf("Upload wasn't spooled in %s", TempFolder)
+	}
+	// Streaming stops at the remaining space, give or take a read
+	if r.read > c.MaxUserBytes+64*1024 {
+		t.Errorf("Read %d bytes with %d bytes of space", r.read, c.MaxUserBytes)
+	}
+}
+
+func TestConcurrentWritesRespectQuota(t *testing.T) {
+	defer setupStorageTest(t)()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	written := 0
+	// 20 files of 100 bytes, with room for 10
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := writeUserFile("alex", fmt.Sprintf("%d.gmi", i), strings.NewReader(strings.Repeat("x", 100)))
+			if err == nil {
+				mu.Lock()
+				written++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if written != 10 {
+		t.Errorf("%d files were written, want 10", written)
+	}
+	actual, _ := computeUsage("alex")
+	if actual.Bytes > c.MaxUserBytes {
+		t.Errorf("User has %d bytes, over the %d byte quota", actual.Bytes, c.MaxUserBytes)
+	}
+	usage, _ := getUserUsage("alex")
+	if usage.Bytes != actual.Bytes || usage.Files != actual.Files {
+		t.Errorf("Recorded usage %+v doesn't match actual usage %+v", usage, actual)
+	}
+}
+
+func TestUsageAccounting(t *testing.T) {
+	defer setupStorageTest(t)()
+	c.MaxFilesPerUser = 2
+	check := func(bytes int64, files int) {
+		t.Helper()
+		usage, err := getUserUsage("alex")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usage.Bytes != bytes || usage.Files != files {
+			t.Errorf("Usage is %d bytes in %d files, want %d bytes in %d files", usage.Bytes, usage.Files, bytes, files)
+		}
+	}
+	writeUserFile("alex", "a.gmi", strings.NewReader("12345"))
+	check(5, 1)
+	// Replacing a file only counts the difference
+	writeUserFile("alex", "a.gmi", strings.NewReader("123"))
+	check(3, 1)
+	makeUserFolder("alex", "folder")
+	writeUserFile("alex", "folder/b.gmi", strings.NewReader("1234"))
+	check(7, 2)
+	if err := writeUserFile("alex", "c.gmi", strings.NewReader("1")); err == nil {
+		t.Errorf("File over MaxFilesPerUser should be refused, but wasn't")
+	}
+	renameUserFile("alex", "folder/b.gmi", "b.gmi")
+	check(7, 2)
+	deleteUserFile("alex", "b.gmi")
+	deleteUserFile("alex", "folder")
+	check(3, 1)
+	// Changes made behind the helpers' backs are found when reconciling
+	store.Write(userFilePath("alex", "d.gmi"), strings.NewReader("12"))
+	check(3, 1)
+	addTestUser(t, "alex", false)
+	reconcileUsage()
+	check(5, 2)
+	// Files that are replaced by a rename no longer count
+	renameUserFile("alex", "d.gmi", "a.gmi")
+	check(2, 1)
+}
+
+func TestConcurrentWritesAreWhole(t *testing.T) {
+	defer setupStorageTest(t)()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			content := strings.Repeat(fmt.Sprint(i), 50+i)
+			if err := writeUserFile("alex", "page.gmi", strings.NewReader(content)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+		// Readers never see a partial file
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := readStorageFile(userFilePath("alex", "page.gmi"))
+			if err == nil && len(data) > 0 && strings.Count(string(data), string(data[:1])) != len(data) {
+				t.Errorf("Read a mix of writes: %s", data)
+			}
+		}()
+	}
+	wg.Wait()
+	data, err := readStorageFile(userFilePath("alex", "page.gmi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := int(data[0] - '0')
+	if len(data) != 50+i {
+		t.Errorf("File has %d bytes, want %d", len(data), 50+i)
+	}
+}
+
+func TestConcurrentFileCommands(t *testing.T) {
+	defer setupStorageTest(t)()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(3)
+		name := fmt.Sprintf("%d.gmi", i)
+		go func() {
+			defer wg.Done()
+			writeUserFile("alex", name, strings.NewReader("hello"))
+		}()
+		go func() {
+			defer wg.Done()
+			renameUserFile("alex", name, "renamed-"+name)
+		}()
+		go func() {
+			defer wg.Done()
+			deleteUserFile("alex", "renamed-"+name)
+		}()
+	}
+	wg.Wait()
+	if tmp, _ := ioutil.ReadDir(path.Join(c.FilesDirectory, TempFolder)); len(tmp) > 0 {
+		t.Errorf("Temp files were left behind")
+	}
+}
+
+func TestUserFileWriter(t *testing.T) {
+	defer setupStorageTest(t)()
+	w, err := newUserFileWriter("alex", "sftp.gmi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Written out of order, as SFTP clients may
+	w.WriteAt([]byte("world"), 6)
+	w.WriteAt([]byte("hello "), 0)
+	if _, err := store.Stat(userFilePath("alex", "sftp.gmi")); !os.IsNotExist(err) {
+		t.Errorf("File is visible before the transfer is finished")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := readStorageFile(userFilePath("alex", "sftp.gmi"))
+	if !bytes.Equal(data, []byte("hello world")) {
+		t.Errorf("Got %q", data)
+	}
+
+	w, _ = newUserFileWriter("alex", "failed.gmi")
+	w.WriteAt([]byte("partial"), 0)
+	w.TransferError(fmt.Errorf("connection lost"))
+	if err := w.Close(); err == nil {
+		t.Errorf("Failed transfer should not be committed")
+	}
+	if _, err := store.Stat(userFilePath("alex", "failed.gmi")); !os.IsNotExist(err) {
+		t.Errorf("Failed transfer left a file behind")
+	}
+}
+
+func TestUserFilePath(t *testing.T) {
+	defer setupStorageTest(t)()
+	for _, name := range []string{"../bob/index.gmi", "/../../etc/passwd"} {
+		p := userFilePath("alex", name)
+		if !strings.HasPrefix(p, getUserDirectory("alex")+"/") {
+			t.Errorf("userFilePath(%q) = %q, outside the user folder", name, p)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Per-site themes: a stylesheet and favicon from the user's own files, a
+// gemtext header and footer, and the format of page titles. Stylesheets are
+// linked from the user's own origin, and the header and footer go through
+// the gemtext renderer, so a theme can't add scripts.
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"path"
+	"strings"
+
+	gmi "git.sr.ht/~adnano/go-gemini"
+)
+
+const maxThemeSnippetBytes = 4000
+
+// Files that can be used as favicons
+var faviconExtensions = map[string]bool{
+	".ico": true, ".png": true, ".gif": true, ".jpg": true, ".jpeg": true, ".svg": true, ".webp": true,
+}
+
+type SiteTheme struct {
+	Stylesheet  string `toml:"stylesheet"`   // name of a .css file in the site
+	Favicon     string `toml:"favicon"`      // name of an image in the site
+	TitleFormat string `toml:"title_format"` // with {title} and {site}, empty for just the page title
+	Header      string `toml:"header"`       // gemtext shown above each page
+	Footer      string `toml:"footer"`       // and below
+}
+
+// The user's theme, empty if they haven't set one
+func getSiteTheme(username string) (*SiteTheme, error) {
+	var s SiteTheme
+	row := DB.QueryRow("SELECT stylesheet, favicon, title_format, header, footer FROM site_theme WHERE username = ?", username)
+	err := row.Scan(&s.Stylesheet, &s.Favicon, &s.TitleFormat, &s.Header, &s.Footer)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Check and tidy up a theme from the theme page or a site.toml
+func (s *SiteTheme) validate() error {
+	s.Stylesheet = strings.TrimSpace(s.Stylesheet)
+	if s.Stylesheet != "" {
+		s.Stylesheet = cleanStorageName(s.Stylesheet)
+		if strings.ToLower(path.Ext(s.Stylesheet)) != ".css" || inHiddenFolder(s.Stylesheet) {
+			return fmt.Errorf("The stylesheet must be a .css file in your site")
+		}
+	}
+	s.Favicon = strings.TrimSpace(s.Favicon)
+	if s.Favicon != "" {
+		s.Favicon = cleanStorageName(s.Favicon)
+		if !faviconExtensions[strings.ToLower(path.Ext(s.Favicon))] || inHiddenFolder(s.Favicon) {
+			return fmt.Errorf("The favicon must be an image in your site")
+		}
+	}
+	s.TitleFormat = strings.TrimSpace(s.TitleFormat)
+	if len(s.TitleFormat) > 200 {
+		return fmt.Errorf("Title format too long")
+	}
+	s.Header = strings.ReplaceAll(s.Header, "\r\n", "\n")
+	s.Footer = strings.ReplaceAll(s.Footer, "\r\n", "\n")
+	if len(s.Header) > maxThemeSnippetBytes || len(s.Footer) > maxThemeSnippetBytes {
+		return fmt.Errorf("Header and footer can be at most %d bytes", maxThemeSnippetBytes)
+	}
+	return nil
+}
+
+func setSiteTheme(username string, s SiteTheme) error {
+	err := s.validate()
+	if err != nil {
+		return err
+	}
+	_, err = DB.Exec(`INSERT INTO site_theme (username, stylesheet, favicon, title_format, header, footer) VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT(username) DO UPDATE SET stylesheet = excluded.stylesheet, favicon = excluded.favicon,
+  title_format = excluded.title_format, header = excluded.header, footer = excluded.footer`,
+		username, s.Stylesheet, s.Favicon, s.TitleFormat, s.Header, s.Footer)
+	return err
+}
+
+// Keep the stylesheet and favicon when they, or a folder they're in, are
+// renamed
+func renameThemeFiles(username string, oldName string, newName string) error {
+	oldName, newName = cleanStorageName(oldName), cleanStorageName(newName)
+	for _, column := range []string{"stylesheet", "favicon"} {
+		_, err := DB.Exec(`UPDATE site_theme SET `+column+` = ? || substr(`+column+`, ?) WHERE username = ? AND (`+column+` = ? OR substr(`+column+`, 1, ?) = ?)`,
+			newName, len(oldName)+1, username, oldName, len(oldName)+1, oldName+"/")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The theme for a user's pages, or nil if themes are disabled or the user
+// hasn't set one. Settings in site.toml win over the theme page.
+func pageTheme(username string) *SiteTheme {
+	if !c.CustomThemes {
+		return nil
+	}
+	theme, err := getSiteTheme(username)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	getSiteConfig(username).applyTheme(theme)
+	if *theme == (SiteTheme{}) {
+		return nil
+	}
+	return theme
+}
+
+// The title of a page in the user's format
+func (s *SiteTheme) PageTitle(title string, site string) string {
+	if s == nil || s.TitleFormat == "" {
+		return title
+	}
+	return strings.NewReplacer("{title}", title, "{site}", site).Replace(s.TitleFormat)
+}
+
+func renderSnippet(snippet string) template.HTML {
+	if snippet == "" {
+		return ""
+	}
+	text, err := gmi.ParseText(strings.NewReader(snippet))
+	if err != nil {
+		return ""
+	}
+	return template.HTML(newHTMLRenderer(nil).Render(text).Content)
+}
+
+func (s *SiteTheme) HeaderHTML() template.HTML {
+	return renderSnippet(s.Header)
+}
+
+func (s *SiteTheme) FooterHTML() template.HTML {
+	return renderSnippet(s.Footer)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSiteTheme(t *testing.T) {
+	defer setupStorageTest(t)()
+	c.CustomThemes = true
+	c.OkExtensions = append(c.OkExtensions, ".css")
+	if err := setSiteTheme("alex", SiteTheme{Stylesheet: "page.gmi"}); err == nil {
+		t.Errorf("Stylesheet that isn't CSS should be refused")
+	}
+	err := setSiteTheme("alex", SiteTheme{Stylesheet: "/css/../style.css", TitleFormat: "{title} | {site}", Header: "=> javascript:alert(1) Hi"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeUserFile("alex", "style.css", strings.NewReader("p {}"))
+	renameUserFile("alex", "style.css", "theme/main.css")
+	theme := pageTheme("alex")
+	if theme == nil || theme.Stylesheet != "theme/main.css" {
+		t.Errorf("Stylesheet should follow the renamed file, got %v", theme)
+	}
+	if got := theme.PageTitle("Hello", "alex.flounder.online"); got != "Hello | alex.flounder.online" {
+		t.Errorf("Got title %q", got)
+	}
+	if got := string(theme.HeaderHTML()); strings.Contains(got, "javascript") || !strings.Contains(got, "Hi") {
+		t.Errorf("Header wasn't rendered safely: %s", got)
+	}
+	c.CustomThemes = false
+	if pageTheme("alex") != nil {
+		t.Errorf("Themes are disabled, but one was used")
+	}
+}
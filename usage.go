@@ -0,0 +1,127 @@
+// Per-user storage usage, kept in the database so quota checks don't have
+// to walk the user's files. The storage helpers update it as files change,
+// and a background job recounts it in case anything drifted.
+package main
+
+import (
+	"database/sql"
+	"log"
+	"os"
+	"time"
+)
+
+type Usage struct {
+	Bytes        int64
+	Files        int
+	ReconciledAt int64 // timestamp
+}
+
+// Count a user's files by walking their folder
+func computeUsage(username string) (Usage, error) {
+	return pathUsage(getUserDirectory(username))
+}
+
+// Count the files in a file or folder in storage
+func pathUsage(fullPath string) (Usage, error) {
+	var usage Usage
+	err := store.Walk(fullPath, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			usage.Bytes += info.Size()
+			usage.Files += 1
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return usage, err
+}
+
+// The user's usage, counted from their files the first time it's needed
+func getUserUsage(username string) (Usage, error) {
+	var usage Usage
+	row := DB.QueryRow("SELECT bytes, files, reconciled_at FROM user_usage WHERE username = ?", username)
+	err := row.Scan(&usage.Bytes, &usage.Files, &usage.ReconciledAt)
+	if err == sql.ErrNoRows {
+		return setUserUsage(username)
+	}
+	return usage, err
+}
+
+// Recount a user's usage and store it
+func setUserUsage(username string) (Usage, error) {
+	usage, err := computeUsage(username)
+	if err != nil {
+		return usage, err
+	}
+	usage.ReconciledAt = time.Now().Unix()
+	_, err = DB.Exec(`INSERT INTO user_usage (username, bytes, files, reconciled_at) VALUES (?, ?, ?, ?)
+ON CONFLICT(username) DO UPDATE SET bytes = excluded.bytes, files = excluded.files, reconciled_at = excluded.reconciled_at`,
+		username, usage.Bytes, usage.Files, usage.ReconciledAt)
+	return usage, err
+}
+
+// Record a change to a user's files. Call with the user locked.
+func addUserUsage(username string, bytes int64, files int) error {
+	// Make sure there's a row to update
+	_, err := getUserUsage(username)
+	if err != nil {
+		return err
+	}
+	_, err = DB.Exec("UPDATE user_usage SET bytes = bytes + ?, files = files + ? WHERE username = ?", bytes, files, username)
+	return err
+}
+
+// Recount everyone's usage, logging any that had drifted. Files are counted
+// without holding the user's lock, and only recounted with it if the totals
+// differ. Users whose usage drifted had files changed behind the helpers'
+// backs, so their file index is rebuilt too.
+func reconcileUsage() {
+	users, err := getUsers()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, user := range users {
+		err = reconcileUserUsage(user.Username)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func reconcileUserUsage(username string) error {
+	counted, err := computeUsage(username)
+	if err != nil {
+		return err
+	}
+	unlock := lockUser(username)
+	defer unlock()
+	old, err := getUserUsage(username)
+	if err != nil {
+		return err
+	}
+	if counted.Bytes == old.Bytes && counted.Files == old.Files {
+		_, err = DB.Exec("UPDATE user_usage SET reconciled_at = ? WHERE username = ?", time.Now().Unix(), username)
+		return err
+	}
+	// Files may have changed since they were counted
+	usage, err := setUserUsage(username)
+	if err != nil || (usage.Bytes == old.Bytes && usage.Files == old.Files) {
+		return err
+	}
+	log.Printf("Usage for %s was %d bytes in %d files, actually %d bytes in %d files",
+		username, old.Bytes, old.Files, usage.Bytes, usage.Files)
+	return reindexUserFiles(username)
+}
+
+func reconcileUsageWorker() {
+	log.Println("Starting usage reconciliation worker")
+	for {
+		reconcileUsage()
+		time.Sleep(time.Hour)
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"net"
 	"os"
 	"path"
-	"path/filepath"
 	"strings"
 	"time"
 	"unicode/utf8"
@@ -28,6 +27,26 @@ func getSchemedFlounderLinkLines(r io.Reader) []string {
 	return result
 }
 
+// The user whose site is at host, by subdomain or custom domain, if any
+func userFromHost(host string) string {
+	if custom := domains[host]; custom != "" {
+		return custom
+	}
+	hostname := strings.SplitN(c.Host, ":", 2)[0]
+	if username := strings.TrimSuffix(host, "."+hostname); username != host && !strings.Contains(username, ".") {
+		return username
+	}
+	return ""
+}
+
+// Whether host, with or without a port, is this instance or one of its
+// subdomains
+func isFlounderHost(host string) bool {
+	hostname := strings.SplitN(host, ":", 2)[0]
+	flounderHost := strings.SplitN(c.Host, ":", 2)[0]
+	return hostname == flounderHost || strings.HasSuffix(hostname, "."+flounderHost)
+}
+
 func isOkUsername(s string) error {
 	if len(s) < 1 {
 		return fmt.Errorf("Username is too short")
@@ -57,9 +76,11 @@ func isTextFile(fullPath string) bool {
 	}
 	const max = 1024 // at least utf8.UTFMax
 	s := make([]byte, 1024)
-	f, err := os.Open(fullPath)
+	f, err := store.Open(fullPath)
 	if os.IsNotExist(err) {
 		return true // for the purposes of editing, we return true
+	} else if err != nil {
+		return false
 	}
 	n, err := f.Read(s)
 	s = s[0:n]
@@ -81,17 +102,18 @@ func isTextFile(fullPath string) bool {
 	return true
 }
 
-// get the user-reltaive local path from the filespath
+// get the user-reltaive local path from the storage name
 // NOTE -- dont use on unsafe input ( I think )
 func getLocalPath(filesPath string) string {
-	l := len(strings.Split(c.FilesDirectory, "/"))
-	return strings.Join(strings.Split(filesPath, "/")[l+1:], "/")
+	parts := strings.SplitN(cleanStorageName(filesPath), "/", 2)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
 }
 
 func getCreator(filePath string) string {
-	l := len(strings.Split(c.FilesDirectory, "/"))
-	r := strings.Split(filePath, "/")[l]
-	return r
+	return strings.SplitN(cleanStorageName(filePath), "/", 2)[0]
 }
 
 func isGemini(filename string) bool {
@@ -99,6 +121,20 @@ func isGemini(filename string) bool {
 	return extension == ".gmi" || extension == ".gemini"
 }
 
+// e.g. "1.5 MB"
+func byteSize(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGT"[exp])
+}
+
 func timeago(t *time.Time) string {
 	d := time.Since(*t)
 	if d.Seconds() < 60 {
@@ -135,40 +171,58 @@ func GetIPFromRemoteAddress(remoteAddress string) string {
 	return remoteAddress
 }
 
-// safe
+// safe. The storage name of the user's folder.
 func getUserDirectory(username string) string {
-	// extra filepath.clean just to be safe
-	userFolder := path.Join(c.FilesDirectory, filepath.Clean(username))
-	return userFolder
+	// extra clean just to be safe
+	return cleanStorageName(username)
 }
 
-// ugh idk
-func safeGetFilePath(username string, filename string) string {
-	return path.Join(getUserDirectory(username), filepath.Clean(filename))
+/// Perform some checks to make sure the file is OK to upload
+func checkIfValidFile(username string, filename string, fileBytes []byte) error {
+	err := checkUserFile(username, filename, int64(len(fileBytes)))
+	if err == nil && cleanStorageName(filename) == siteConfigFile {
+		_, err = parseSiteConfig(fileBytes)
+	}
+	return err
 }
 
-func dirSize(path string) (int64, error) {
-	var size int64
-	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if !info.IsDir() {
-			size += info.Size()
-		}
+// Like checkIfValidFile, for a file of the given size that isn't in memory
+func checkUserFile(username string, filename string, fileSize int64) error {
+	err := checkFileName(filename)
+	if err != nil {
 		return err
-	})
-	return size, err
+	}
+	if fileSize > int64(c.MaxFileBytes) {
+		return fmt.Errorf("File too large. File was %d bytes, Max file size is %d", fileSize, c.MaxFileBytes)
+	}
+	usage, err := getUserUsage(username)
+	if err != nil {
+		return err
+	}
+	// Existing files are replaced, so don't count twice
+	existing, err := store.Stat(userFilePath(username, filename))
+	if err == nil {
+		usage.Bytes -= existing.Size()
+	} else if usage.Files >= c.MaxFilesPerUser {
+		return fmt.Errorf("You have reached the max number of files. Delete some before uploading")
+	}
+	if usage.Bytes+fileSize > c.MaxUserBytes {
+		return fmt.Errorf("You are out of storage space. Delete some files before continuing.")
+	}
+	return nil
 }
 
-/// Perform some checks to make sure the file is OK to upload
-func checkIfValidFile(username string, filename string, fileBytes []byte) error {
+// Check the name and extension of a file
+func checkFileName(filename string) error {
 	if len(filename) == 0 {
 		return fmt.Errorf("Please enter a filename")
 	}
 	if len(filename) > 256 { // arbitrarily chosen
 		return fmt.Errorf("Filename is too long")
 	}
+	if cleanStorageName(filename) == siteConfigFile {
+		return nil
+	}
 	ext := strings.ToLower(path.Ext(filename))
 	found := false
 	for _, mimetype := range c.OkExtensions {
@@ -179,38 +233,23 @@ func checkIfValidFile(username string, filename string, fileBytes []byte) error
 	if !found {
 		return fmt.Errorf("Invalid file extension: %s", ext)
 	}
-	if len(fileBytes) > c.MaxFileBytes {
-		return fmt.Errorf("File too large. File was %d bytes, Max file size is %d", len(fileBytes), c.MaxFileBytes)
-	}
-	userFolder := getUserDirectory(username)
-	myFiles, err := getMyFilesRecursive(userFolder, username)
-	if err != nil {
-		return err
-	}
-	if len(myFiles) >= c.MaxFilesPerUser {
-		return fmt.Errorf("You have reached the max number of files. Delete some before uploading")
-	}
-	size, err := dirSize(userFolder)
-	if err != nil || size+int64(len(fileBytes)) > c.MaxUserBytes {
-		return fmt.Errorf("You are out of storage space. Delete some files before continuing.")
-	}
 	return nil
 }
 
 func zipit(source string, target io.Writer) error {
 	archive := zip.NewWriter(target)
 
-	info, err := os.Stat(source)
+	info, err := store.Stat(source)
 	if err != nil {
 		return nil
 	}
 
 	var baseDir string
 	if info.IsDir() {
-		baseDir = filepath.Base(source)
+		baseDir = path.Base(source)
 	}
 
-	filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+	err = store.Walk(source, func(name string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -221,7 +260,7 @@ func zipit(source string, target io.Writer) error {
 		}
 
 		if baseDir != "" {
-			header.Name = filepath.Join(baseDir, strings.TrimPrefix(path, source))
+			header.Name = path.Join(baseDir, strings.TrimPrefix(name, source))
 		}
 
 		if info.IsDir() {
@@ -239,7 +278,7 @@ func zipit(source string, target io.Writer) error {
 			return nil
 		}
 
-		file, err := os.Open(path)
+		file, err := store.Open(name)
 		if err != nil {
 			return err
 		}